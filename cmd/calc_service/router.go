@@ -0,0 +1,63 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+
+	"distributed-calculator/internal/auth"
+	"distributed-calculator/internal/calculator"
+	"distributed-calculator/internal/idempotency"
+	"distributed-calculator/internal/webhook"
+)
+
+func SetupRouter(db *sql.DB) http.Handler {
+	dispatcher := webhook.NewDispatcher(db)
+	if err := dispatcher.FailInterrupted(); err != nil {
+		log.Printf("webhooks: failed to close interrupted deliveries: %v", err)
+	}
+	calculator.InitWebhooks(dispatcher)
+	calculator.InitMemo(calculator.NewMemo(10000))
+	if cfg, ok := auth.OIDCConfigFromEnv(); ok {
+		auth.InitOIDC(auth.NewOIDCProvider(cfg))
+	}
+
+	authed := func(h http.Handler, scopes ...string) http.Handler {
+		return auth.JWTMiddleware(db, h, scopes...)
+	}
+	admin := func(h http.Handler) http.Handler {
+		return authed(auth.RequireRole(h, auth.RoleAdmin))
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/v1/register", auth.RegisterHandler(db))
+	mux.Handle("/api/v1/login", auth.LoginHandler(db))
+	mux.Handle("POST /api/v1/login/2fa", auth.LoginTOTPHandler(db))
+	mux.Handle("GET /api/v1/auth/oidc/login", auth.OIDCLoginHandler())
+	mux.Handle("GET /api/v1/auth/oidc/callback", auth.OIDCCallbackHandler(db))
+	mux.Handle("GET /api/v1/me", authed(auth.MeHandler(db)))
+	mux.Handle("POST /api/v1/me/password", authed(auth.ChangePasswordHandler(db)))
+	mux.Handle("DELETE /api/v1/me", authed(auth.DeleteAccountHandler(db)))
+	mux.Handle("POST /api/v1/me/2fa/enroll", authed(auth.EnrollTOTPHandler(db)))
+	mux.Handle("POST /api/v1/me/2fa/confirm", authed(auth.ConfirmTOTPHandler(db)))
+	mux.Handle("/api/v1/calculate", authed(idempotency.Middleware(db, calculator.CalculateHandler(db)), auth.ScopeCalculate))
+	mux.Handle("POST /api/v1/calculate/batch", authed(idempotency.Middleware(db, calculator.BatchCalculateHandler(db)), auth.ScopeCalculate))
+	mux.Handle("GET /api/v1/calculations", authed(calculator.HistoryHandler(db), auth.ScopeReadHistory))
+	mux.Handle("POST /api/v1/webhooks", authed(webhook.RegisterEndpointHandler(db)))
+	mux.Handle("GET /api/v1/webhooks", authed(webhook.ListEndpointsHandler(db)))
+	mux.Handle("DELETE /api/v1/webhooks/{id}", authed(webhook.DeleteEndpointHandler(db)))
+	mux.Handle("GET /api/v1/webhooks/deliveries", authed(webhook.DeliveriesHandler(db)))
+	mux.Handle("POST /api/v1/api-keys", authed(auth.CreateAPIKeyHandler(db)))
+	mux.Handle("GET /api/v1/api-keys", authed(auth.ListAPIKeysHandler(db)))
+	mux.Handle("DELETE /api/v1/api-keys/{id}", authed(auth.RevokeAPIKeyHandler(db)))
+	mux.Handle("GET /api/v1/stats", admin(calculator.StatsHandler()))
+
+	mux.Handle("GET /api/v1/admin/users", admin(auth.ListUsersHandler(db)))
+	mux.Handle("POST /api/v1/admin/users/{id}/disable", admin(auth.SetDisabledHandler(db, true)))
+	mux.Handle("POST /api/v1/admin/users/{id}/enable", admin(auth.SetDisabledHandler(db, false)))
+	mux.Handle("POST /api/v1/admin/users/{id}/role", admin(auth.SetRoleHandler(db)))
+	mux.Handle("POST /api/v1/admin/users/{id}/logout", admin(auth.ForceLogoutHandler(db)))
+	mux.Handle("POST /api/v1/admin/users/{id}/2fa/reset", admin(auth.ResetTOTPHandler(db)))
+	mux.Handle("GET /api/v1/admin/users/{id}/calculations", admin(calculator.UserCalculationsHandler(db)))
+	return mux
+}
@@ -8,23 +8,15 @@ import (
 	"net/http/httptest"
 	"testing"
 
-	_ "github.com/mattn/go-sqlite3"
+	"distributed-calculator/internal/storage"
 )
 
 func setupTestDB(t *testing.T) *sql.DB {
-	db, err := sql.Open("sqlite3", ":memory:")
+	db, err := storage.NewSQLite(":memory:")
 	if err != nil {
 		t.Fatalf("failed to open test db: %v", err)
 	}
-
-	_, err = db.Exec(`CREATE TABLE users (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		login TEXT UNIQUE NOT NULL,
-		password_hash TEXT NOT NULL
-	)`)
-	if err != nil {
-		t.Fatalf("failed to create table: %v", err)
-	}
+	db.SetMaxOpenConns(1)
 
 	return db
 }
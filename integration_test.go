@@ -60,7 +60,7 @@ func SetupServer(t *testing.T) (http.Handler, *sql.DB) {
 func TestIntegration_FullFlow(t *testing.T) {
 	handler, _ := SetupServer(t)
 
-	registerPayload := `{"login":"user1","password":"pass123"}`
+	registerPayload := `{"login":"user1","password":"calc-pass-2024"}`
 	req := httptest.NewRequest(http.MethodPost, "/api/v1/register", bytes.NewBufferString(registerPayload))
 	req.Header.Set("Content-Type", "application/json")
 	w := httptest.NewRecorder()
@@ -70,7 +70,7 @@ func TestIntegration_FullFlow(t *testing.T) {
 		t.Fatalf("register failed: status %d", w.Result().StatusCode)
 	}
 
-	loginPayload := `{"login":"user1","password":"pass123"}`
+	loginPayload := `{"login":"user1","password":"calc-pass-2024"}`
 	req = httptest.NewRequest(http.MethodPost, "/api/v1/login", bytes.NewBufferString(loginPayload))
 	req.Header.Set("Content-Type", "application/json")
 	w = httptest.NewRecorder()
@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ReauthWindow - насколько свежим должен быть вход, чтобы пользователь без
+// пароля (из SSO) мог подтвердить удаление аккаунта или включение 2FA.
+var ReauthWindow = 5 * time.Minute
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+func MeHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := UserIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var user UserSummary
+		err := db.QueryRowContext(r.Context(), "SELECT id, login, role, disabled, totp_enabled FROM users WHERE id = ?", userID).
+			Scan(&user.ID, &user.Login, &user.Role, &user.Disabled, &user.TOTPEnabled)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "user not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "failed to load user", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(user)
+	}
+}
+
+// checkCurrentPassword загружает пользователя и сверяет пароль. Попытки
+// ограничены тем же лимитом, что и вход, чтобы украденный токен не давал
+// подбирать пароль. У пользователя без пароля вместо него проверяется, что
+// токен выдан не раньше ReauthWindow назад. При ошибке ответ уже записан.
+func checkCurrentPassword(w http.ResponseWriter, r *http.Request, db *sql.DB, password string) (User, bool) {
+	var user User
+	userID, ok := UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return user, false
+	}
+	err := db.QueryRowContext(r.Context(), "SELECT id, login, password_hash, role, disabled, token_version, totp_enabled FROM users WHERE id = ?", userID).
+		Scan(&user.ID, &user.Login, &user.PasswordHash, &user.Role, &user.Disabled, &user.TokenVersion, &user.TOTPEnabled)
+	if err != nil {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return user, false
+	}
+	if ok, retryAfter := LoginNameLimiter.Allow(user.Login); !ok {
+		tooManyRequests(w, "too many attempts", retryAfter)
+		return user, false
+	}
+	if user.PasswordHash == unusablePasswordHash {
+		issuedAt, ok := r.Context().Value(IssuedAtKey).(time.Time)
+		if !ok || time.Since(issuedAt) > ReauthWindow {
+			http.Error(w, "recent sign-in required", http.StatusForbidden)
+			return user, false
+		}
+		return user, true
+	}
+	if comparePassword(user.PasswordHash, password) != nil {
+		http.Error(w, "invalid password", http.StatusForbidden)
+		return user, false
+	}
+	return user, true
+}
+
+// ChangePasswordHandler меняет пароль и отзывает все выданные токены.
+// Текущая сессия продолжается с новым токеном из ответа.
+func ChangePasswordHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ChangePasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		user, ok := checkCurrentPassword(w, r, db, req.CurrentPassword)
+		if !ok {
+			return
+		}
+		// Пользователь из SSO входит только через провайдера.
+		if user.PasswordHash == unusablePasswordHash {
+			http.Error(w, "password is managed by sso provider", http.StatusForbidden)
+			return
+		}
+		if msg := Policy.Validate(req.NewPassword, user.Login); msg != "" {
+			writeValidationErrors(w, ValidationErrors{"new_password": msg})
+			return
+		}
+		hash, err := hashPassword(req.NewPassword)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		err = db.QueryRowContext(r.Context(),
+			"UPDATE users SET password_hash = ?, token_version = token_version + 1 WHERE id = ? RETURNING token_version",
+			hash, user.ID,
+		).Scan(&user.TokenVersion)
+		if err != nil {
+			http.Error(w, "failed to update password", http.StatusInternalServerError)
+			return
+		}
+		tokenString, err := issueToken(user)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"token": tokenString})
+	}
+}
+
+// DeleteAccountHandler удаляет пользователя. Его вычисления, webhook-и,
+// API-ключи и ключи идемпотентности удаляются каскадно внешними ключами.
+func DeleteAccountHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req DeleteAccountRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		user, ok := checkCurrentPassword(w, r, db, req.Password)
+		if !ok {
+			return
+		}
+		if _, err := db.ExecContext(r.Context(), "DELETE FROM users WHERE id = ?", user.ID); err != nil {
+			http.Error(w, "failed to delete account", http.StatusInternalServerError)
+			return
+		}
+		// Аккаунт уже удалён, поэтому ошибка только пишется в лог.
+		if err := resetLoginFailures(db, user.Login); err != nil {
+			log.Printf("auth: failed to reset login failures for %q: %v", user.Login, err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+const (
+	RoleUser          = "user"
+	RoleAdmin         = "admin"
+	RoleAgentOperator = "agent-operator"
+)
+
+var Roles = []string{RoleUser, RoleAdmin, RoleAgentOperator}
+
+var ErrUserNotFound = errors.New("user not found")
+
+type UserSummary struct {
+	ID          int64  `json:"id"`
+	Login       string `json:"login"`
+	Role        string `json:"role"`
+	Disabled    bool   `json:"disabled"`
+	TOTPEnabled bool   `json:"totp_enabled"`
+}
+
+type SetRoleRequest struct {
+	Role string `json:"role"`
+}
+
+// RequireRole пропускает запрос, только если роль из токена входит в roles.
+// Ставится после JWTMiddleware.
+func RequireRole(next http.Handler, roles ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role, ok := RoleFromContext(r.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !slices.Contains(roles, role) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SetRole меняет роль пользователя. Выданные ранее токены отзываются,
+// чтобы роль в claims не расходилась с базой.
+func SetRole(db *sql.DB, userID int64, role string) error {
+	if !slices.Contains(Roles, role) {
+		return errors.New("unknown role")
+	}
+	return updateUser(db, "UPDATE users SET role = ?, token_version = token_version + 1 WHERE id = ?", role, userID)
+}
+
+// RevokeTokens делает недействительными все выданные пользователю токены.
+func RevokeTokens(db *sql.DB, userID int64) error {
+	return updateUser(db, "UPDATE users SET token_version = token_version + 1 WHERE id = ?", userID)
+}
+
+func updateUser(db *sql.DB, query string, args ...interface{}) error {
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func pathUserID(r *http.Request) (int64, error) {
+	return strconv.ParseInt(r.PathValue("id"), 10, 64)
+}
+
+func ListUsersHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.QueryContext(r.Context(), "SELECT id, login, role, disabled, totp_enabled FROM users ORDER BY id")
+		if err != nil {
+			http.Error(w, "failed to load users", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		users := []UserSummary{}
+		for rows.Next() {
+			var user UserSummary
+			if err := rows.Scan(&user.ID, &user.Login, &user.Role, &user.Disabled, &user.TOTPEnabled); err != nil {
+				http.Error(w, "failed to load users", http.StatusInternalServerError)
+				return
+			}
+			users = append(users, user)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "failed to load users", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(users)
+	}
+}
+
+func SetDisabledHandler(db *sql.DB, disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := pathUserID(r)
+		if err != nil {
+			http.Error(w, "invalid user id", http.StatusBadRequest)
+			return
+		}
+		if currentID, _ := UserIDFromContext(r.Context()); disabled && currentID == userID {
+			http.Error(w, "cannot disable own account", http.StatusBadRequest)
+			return
+		}
+		err = updateUser(db, "UPDATE users SET disabled = ?, token_version = token_version + 1 WHERE id = ?", disabled, userID)
+		writeUpdateResult(w, err)
+	}
+}
+
+func SetRoleHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := pathUserID(r)
+		if err != nil {
+			http.Error(w, "invalid user id", http.StatusBadRequest)
+			return
+		}
+		var req SetRoleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if !slices.Contains(Roles, req.Role) {
+			http.Error(w, "unknown role", http.StatusBadRequest)
+			return
+		}
+		writeUpdateResult(w, SetRole(db, userID, req.Role))
+	}
+}
+
+func ForceLogoutHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := pathUserID(r)
+		if err != nil {
+			http.Error(w, "invalid user id", http.StatusBadRequest)
+			return
+		}
+		writeUpdateResult(w, RevokeTokens(db, userID))
+	}
+}
+
+func writeUpdateResult(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		http.Error(w, "user not found", http.StatusNotFound)
+	case err != nil:
+		http.Error(w, "failed to update user", http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
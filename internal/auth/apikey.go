@@ -0,0 +1,258 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ScopeCalculate   = "calculate"
+	ScopeReadHistory = "read-history"
+)
+
+var Scopes = []string{ScopeCalculate, ScopeReadHistory}
+
+const (
+	APIKeyHeader = "X-API-Key"
+	apiKeyPrefix = "dck_"
+)
+
+var errInvalidAPIKey = errors.New("invalid api key")
+
+type APIKey struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Key        string     `json:"key,omitempty"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *string    `json:"last_used_at,omitempty"`
+	CreatedAt  string     `json:"created_at"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// apiKeyFromRequest достаёт ключ из "Authorization: ApiKey ..." или X-API-Key.
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		return key
+	}
+	if key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "ApiKey "); ok {
+		return key
+	}
+	return ""
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateAPIKey возвращает ключ вида dck_<prefix>_<secret> и его видимый префикс.
+func generateAPIKey() (key, prefix string, err error) {
+	buf := make([]byte, 6+32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	prefix = hex.EncodeToString(buf[:6])
+	key = apiKeyPrefix + prefix + "_" + base64.RawURLEncoding.EncodeToString(buf[6:])
+	return key, prefix, nil
+}
+
+// authenticateAPIKey проверяет ключ и возвращает контекст с владельцем ключа и его правами.
+func authenticateAPIKey(ctx context.Context, db *sql.DB, key string) (context.Context, error) {
+	rest, ok := strings.CutPrefix(key, apiKeyPrefix)
+	if !ok {
+		return nil, errInvalidAPIKey
+	}
+	prefix, _, ok := strings.Cut(rest, "_")
+	if !ok {
+		return nil, errInvalidAPIKey
+	}
+
+	var id, userID int64
+	var keyHash, scopes, role string
+	var expiresAt sql.NullInt64
+	var disabled bool
+	err := db.QueryRowContext(ctx,
+		`SELECT k.id, k.user_id, k.key_hash, k.scopes, k.expires_at, u.role, u.disabled
+		FROM api_keys k JOIN users u ON u.id = k.user_id
+		WHERE k.prefix = ? AND k.revoked_at IS NULL`,
+		prefix,
+	).Scan(&id, &userID, &keyHash, &scopes, &expiresAt, &role, &disabled)
+	if err != nil {
+		return nil, errInvalidAPIKey
+	}
+	if subtle.ConstantTimeCompare([]byte(keyHash), []byte(hashAPIKey(key))) != 1 {
+		return nil, errInvalidAPIKey
+	}
+	if disabled || (expiresAt.Valid && time.Now().Unix() >= expiresAt.Int64) {
+		return nil, errInvalidAPIKey
+	}
+	// Запрос не отклоняется из-за отметки времени, но ошибка не теряется.
+	if _, err := db.ExecContext(ctx, "UPDATE api_keys SET last_used_at = CURRENT_TIMESTAMP WHERE id = ?", id); err != nil {
+		log.Printf("auth: failed to update api key last use: %v", err)
+	}
+
+	ctx = context.WithValue(ctx, UserIDKey, userID)
+	ctx = context.WithValue(ctx, RoleKey, role)
+	ctx = context.WithValue(ctx, ScopesKey, strings.Split(scopes, ","))
+	return ctx, nil
+}
+
+// ScopesFromContext возвращает права API-ключа. Для запросов с JWT ok == false:
+// сессия пользователя ограничена только ролью.
+func ScopesFromContext(ctx context.Context) ([]string, bool) {
+	scopes, ok := ctx.Value(ScopesKey).([]string)
+	return scopes, ok
+}
+
+func CreateAPIKeyHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := UserIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req CreateAPIKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		errs := ValidationErrors{}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" || len(req.Name) > 100 {
+			errs["name"] = "name required, at most 100 characters"
+		}
+		if len(req.Scopes) == 0 {
+			req.Scopes = Scopes
+		}
+		for _, scope := range req.Scopes {
+			if !slices.Contains(Scopes, scope) {
+				errs["scopes"] = "unknown scope " + strconv.Quote(scope)
+			}
+		}
+		if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+			errs["expires_at"] = "expires_at must be in the future"
+		}
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+
+		key, prefix, err := generateAPIKey()
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		var expiresAt sql.NullInt64
+		if req.ExpiresAt != nil {
+			expiresAt = sql.NullInt64{Int64: req.ExpiresAt.Unix(), Valid: true}
+		}
+		scopes := slices.Compact(slices.Sorted(slices.Values(req.Scopes)))
+		apiKey := APIKey{Name: req.Name, Prefix: prefix, Key: key, Scopes: scopes, ExpiresAt: req.ExpiresAt}
+		err = db.QueryRowContext(r.Context(),
+			`INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, expires_at, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP) RETURNING id, created_at`,
+			userID, apiKey.Name, prefix, hashAPIKey(key), strings.Join(scopes, ","), expiresAt,
+		).Scan(&apiKey.ID, &apiKey.CreatedAt)
+		if err != nil {
+			http.Error(w, "failed to save api key", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(apiKey)
+	}
+}
+
+func ListAPIKeysHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := UserIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		rows, err := db.QueryContext(r.Context(),
+			`SELECT id, name, prefix, scopes, expires_at, last_used_at, created_at
+			FROM api_keys WHERE user_id = ? AND revoked_at IS NULL ORDER BY id`,
+			userID,
+		)
+		if err != nil {
+			http.Error(w, "failed to load api keys", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		keys := []APIKey{}
+		for rows.Next() {
+			var key APIKey
+			var scopes string
+			var expiresAt sql.NullInt64
+			var lastUsedAt sql.NullString
+			if err := rows.Scan(&key.ID, &key.Name, &key.Prefix, &scopes, &expiresAt, &lastUsedAt, &key.CreatedAt); err != nil {
+				http.Error(w, "failed to load api keys", http.StatusInternalServerError)
+				return
+			}
+			key.Scopes = strings.Split(scopes, ",")
+			if expiresAt.Valid {
+				t := time.Unix(expiresAt.Int64, 0).UTC()
+				key.ExpiresAt = &t
+			}
+			if lastUsedAt.Valid {
+				key.LastUsedAt = &lastUsedAt.String
+			}
+			keys = append(keys, key)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "failed to load api keys", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keys)
+	}
+}
+
+func RevokeAPIKeyHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := UserIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid api key id", http.StatusBadRequest)
+			return
+		}
+		res, err := db.ExecContext(r.Context(),
+			"UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP WHERE id = ? AND user_id = ? AND revoked_at IS NULL",
+			id, userID,
+		)
+		if err != nil {
+			http.Error(w, "failed to revoke api key", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "api key not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
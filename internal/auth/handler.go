@@ -5,11 +5,11 @@ import (
 	"database/sql"
 	"encoding/json"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var jwtSecret = []byte("your-secret-key")
@@ -18,6 +18,10 @@ type User struct {
 	ID           int64
 	Login        string
 	PasswordHash string
+	Role         string
+	Disabled     bool
+	TokenVersion int64
+	TOTPEnabled  bool
 }
 
 type RegisterRequest struct {
@@ -31,13 +35,21 @@ type LoginRequest struct {
 }
 
 type Claims struct {
-	UserID int64 `json:"user_id"`
+	UserID       int64  `json:"user_id"`
+	Role         string `json:"role"`
+	TokenVersion int64  `json:"ver"`
 	jwt.RegisteredClaims
 }
 
 type contextKey string
 
-const UserIDKey = contextKey("userID")
+const (
+	UserIDKey = contextKey("userID")
+	RoleKey   = contextKey("role")
+	ScopesKey = contextKey("scopes")
+	// IssuedAtKey - время выдачи JWT; у запросов с API-ключом его нет.
+	IssuedAtKey = contextKey("issuedAt")
+)
 
 func RegisterHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -46,16 +58,31 @@ func RegisterHandler(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "invalid request", http.StatusBadRequest)
 			return
 		}
-		if req.Login == "" || req.Password == "" {
-			http.Error(w, "login and password required", http.StatusBadRequest)
+		if ok, retryAfter := RegisterIPLimiter.Allow(clientIP(r)); !ok {
+			tooManyRequests(w, "too many registrations", retryAfter)
+			return
+		}
+		login := NormalizeLogin(req.Login)
+		if errs := validateCredentials(login, req.Password); len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+		// Логины, созданные до нормализации, могут быть в другом регистре.
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE login = ? COLLATE NOCASE)", login).Scan(&exists); err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if exists {
+			writeValidationErrors(w, ValidationErrors{"login": "login already taken"})
 			return
 		}
-		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		hash, err := hashPassword(req.Password)
 		if err != nil {
 			http.Error(w, "internal error", http.StatusInternalServerError)
 			return
 		}
-		_, err = db.Exec("INSERT INTO users (login, password_hash) VALUES (?, ?)", req.Login, string(hash))
+		_, err = db.Exec("INSERT INTO users (login, password_hash) VALUES (?, ?)", login, hash)
 		if err != nil {
 			http.Error(w, "user exists or db error", http.StatusBadRequest)
 			return
@@ -72,24 +99,65 @@ func LoginHandler(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "invalid request", http.StatusBadRequest)
 			return
 		}
+		login := NormalizeLogin(req.Login)
+		if ok, retryAfter := LoginIPLimiter.Allow(clientIP(r)); !ok {
+			tooManyRequests(w, "too many login attempts", retryAfter)
+			return
+		}
+		if ok, retryAfter := LoginNameLimiter.Allow(login); !ok {
+			tooManyRequests(w, "too many login attempts", retryAfter)
+			return
+		}
+		locked, err := lockedFor(db, login)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if locked > 0 {
+			tooManyRequests(w, "too many failed login attempts", locked)
+			return
+		}
+
 		var user User
-		err := db.QueryRow("SELECT id, password_hash FROM users WHERE login = ?", req.Login).Scan(&user.ID, &user.PasswordHash)
+		err = db.QueryRow("SELECT id, password_hash, role, disabled, token_version, totp_enabled FROM users WHERE login = ? COLLATE NOCASE", login).
+			Scan(&user.ID, &user.PasswordHash, &user.Role, &user.Disabled, &user.TokenVersion, &user.TOTPEnabled)
 		if err != nil {
+			compareDummyPassword(req.Password)
+			if err := recordLoginFailure(db, login); err != nil {
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
 			http.Error(w, "invalid login or password", http.StatusUnauthorized)
 			return
 		}
-		if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
+		if err := comparePassword(user.PasswordHash, req.Password); err != nil {
+			if err := recordLoginFailure(db, login); err != nil {
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
 			http.Error(w, "invalid login or password", http.StatusUnauthorized)
 			return
 		}
-		claims := &Claims{
-			UserID: user.ID,
-			RegisteredClaims: jwt.RegisteredClaims{
-				ExpiresAt: jwt.NewNumericDate(time.Now().Add(72 * time.Hour)),
-			},
+		if user.Disabled {
+			http.Error(w, "account disabled", http.StatusForbidden)
+			return
+		}
+		// Со вторым фактором счётчик неудач сбрасывается только после кода.
+		if user.TOTPEnabled {
+			mfaToken, err := issueMFAToken(user)
+			if err != nil {
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"mfa_required": true, "mfa_token": mfaToken})
+			return
 		}
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-		tokenString, err := token.SignedString(jwtSecret)
+		if err := resetLoginFailures(db, login); err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		tokenString, err := issueToken(user)
 		if err != nil {
 			http.Error(w, "internal error", http.StatusInternalServerError)
 			return
@@ -99,6 +167,20 @@ func LoginHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
+func issueToken(user User) (string, error) {
+	claims := &Claims{
+		UserID:       user.ID,
+		Role:         user.Role,
+		TokenVersion: user.TokenVersion,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(72 * time.Hour)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(jwtSecret)
+}
+
 func ParseToken(tokenStr string) (*Claims, error) {
 	token, err := jwt.ParseWithClaims(tokenStr, &Claims{}, func(token *jwt.Token) (interface{}, error) {
 		return jwtSecret, nil
@@ -106,14 +188,34 @@ func ParseToken(tokenStr string) (*Claims, error) {
 	if err != nil {
 		return nil, err
 	}
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
+	// У сессионных токенов нет audience, у токенов второго шага входа - "mfa".
+	if claims, ok := token.Claims.(*Claims); ok && token.Valid && len(claims.Audience) == 0 {
 		return claims, nil
 	}
 	return nil, jwt.ErrTokenInvalidClaims
 }
 
-func JWTMiddleware(next http.Handler) http.Handler {
+// JWTMiddleware проверяет токен и состояние пользователя в базе, чтобы
+// блокировка и принудительный выход действовали сразу, а не по истечении токена.
+// API-ключи принимаются, только если маршрут перечисляет нужные права в scopes
+// и все они выданы ключу.
+func JWTMiddleware(db *sql.DB, next http.Handler, scopes ...string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key := apiKeyFromRequest(r); key != "" {
+			ctx, err := authenticateAPIKey(r.Context(), db, key)
+			if err != nil {
+				http.Error(w, "invalid api key", http.StatusUnauthorized)
+				return
+			}
+			granted, _ := ScopesFromContext(ctx)
+			if len(scopes) == 0 || slices.ContainsFunc(scopes, func(scope string) bool { return !slices.Contains(granted, scope) }) {
+				http.Error(w, "api key not allowed for this endpoint", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
 			http.Error(w, "missing token", http.StatusUnauthorized)
@@ -129,7 +231,19 @@ func JWTMiddleware(next http.Handler) http.Handler {
 			http.Error(w, "invalid token", http.StatusUnauthorized)
 			return
 		}
+		var disabled bool
+		var tokenVersion int64
+		err = db.QueryRowContext(r.Context(), "SELECT disabled, token_version FROM users WHERE id = ?", claims.UserID).
+			Scan(&disabled, &tokenVersion)
+		if err != nil || disabled || tokenVersion != claims.TokenVersion {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
 		ctx := context.WithValue(r.Context(), UserIDKey, claims.UserID)
+		ctx = context.WithValue(ctx, RoleKey, claims.Role)
+		if claims.IssuedAt != nil {
+			ctx = context.WithValue(ctx, IssuedAtKey, claims.IssuedAt.Time)
+		}
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -138,3 +252,8 @@ func UserIDFromContext(ctx context.Context) (int64, bool) {
 	userID, ok := ctx.Value(UserIDKey).(int64)
 	return userID, ok
 }
+
+func RoleFromContext(ctx context.Context) (string, bool) {
+	role, ok := ctx.Value(RoleKey).(string)
+	return role, ok
+}
@@ -0,0 +1,609 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"distributed-calculator/internal/storage"
+)
+
+func setupSQLTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := storage.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("failed to open test db: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	// Все запросы в тестах идут с одного адреса, поэтому у каждого теста
+	// свои ограничители.
+	LoginIPLimiter = NewRateLimiter(1000, 1000)
+	LoginNameLimiter = NewRateLimiter(1000, 1000)
+	RegisterIPLimiter = NewRateLimiter(1000, 1000)
+	return db
+}
+
+func postJSON(t *testing.T, handler http.Handler, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func registerUser(t *testing.T, db *sql.DB, login, password string) int64 {
+	t.Helper()
+	body := `{"login":"` + login + `","password":"` + password + `"}`
+	if w := postJSON(t, RegisterHandler(db), "/api/v1/register", body); w.Code != http.StatusOK {
+		t.Fatalf("register failed: %d %s", w.Code, w.Body.String())
+	}
+	var id int64
+	if err := db.QueryRow("SELECT id FROM users WHERE login = ?", NormalizeLogin(login)).Scan(&id); err != nil {
+		t.Fatalf("failed to load user id: %v", err)
+	}
+	return id
+}
+
+func loginUser(t *testing.T, db *sql.DB, login, password string) (string, int) {
+	t.Helper()
+	body := `{"login":"` + login + `","password":"` + password + `"}`
+	w := postJSON(t, LoginHandler(db), "/api/v1/login", body)
+	var resp map[string]string
+	json.NewDecoder(w.Body).Decode(&resp)
+	return resp["token"], w.Code
+}
+
+func callWithToken(handler http.Handler, token string) int {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w.Code
+}
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+})
+
+func TestLoginTokenCarriesRole(t *testing.T) {
+	db := setupSQLTestDB(t)
+	registerUser(t, db, "roleuser", "secret123")
+
+	token, code := loginUser(t, db, "roleuser", "secret123")
+	if code != http.StatusOK {
+		t.Fatalf("expected login to succeed, got %d", code)
+	}
+	claims, err := ParseToken(token)
+	if err != nil {
+		t.Fatalf("failed to parse token: %v", err)
+	}
+	if claims.Role != RoleUser {
+		t.Fatalf("expected role %q in claims, got %q", RoleUser, claims.Role)
+	}
+}
+
+func TestJWTMiddleware_ForceLogout(t *testing.T) {
+	db := setupSQLTestDB(t)
+	userID := registerUser(t, db, "logoutuser", "secret123")
+	token, _ := loginUser(t, db, "logoutuser", "secret123")
+
+	handler := JWTMiddleware(db, okHandler)
+	if code := callWithToken(handler, token); code != http.StatusOK {
+		t.Fatalf("expected valid token to pass, got %d", code)
+	}
+
+	if err := RevokeTokens(db, userID); err != nil {
+		t.Fatalf("failed to revoke tokens: %v", err)
+	}
+	if code := callWithToken(handler, token); code != http.StatusUnauthorized {
+		t.Fatalf("expected revoked token to be rejected, got %d", code)
+	}
+}
+
+func TestDisabledUser(t *testing.T) {
+	db := setupSQLTestDB(t)
+	adminID := registerUser(t, db, "admin", "secret123")
+	userID := registerUser(t, db, "baduser", "secret123")
+	if err := SetRole(db, adminID, RoleAdmin); err != nil {
+		t.Fatalf("failed to set role: %v", err)
+	}
+	adminToken, _ := loginUser(t, db, "admin", "secret123")
+	userToken, _ := loginUser(t, db, "baduser", "secret123")
+
+	mux := http.NewServeMux()
+	mux.Handle("POST /admin/users/{id}/disable", JWTMiddleware(db, RequireRole(SetDisabledHandler(db, true), RoleAdmin)))
+	req := httptest.NewRequest(http.MethodPost, "/admin/users/"+strconv.FormatInt(userID, 10)+"/disable", nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected disable to succeed, got %d", w.Code)
+	}
+
+	if code := callWithToken(JWTMiddleware(db, okHandler), userToken); code != http.StatusUnauthorized {
+		t.Fatalf("expected disabled user's token to be rejected, got %d", code)
+	}
+	if _, code := loginUser(t, db, "baduser", "secret123"); code != http.StatusForbidden {
+		t.Fatalf("expected disabled user login to be forbidden, got %d", code)
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	db := setupSQLTestDB(t)
+	userID := registerUser(t, db, "promoted", "secret123")
+	token, _ := loginUser(t, db, "promoted", "secret123")
+
+	handler := JWTMiddleware(db, RequireRole(okHandler, RoleAdmin))
+	if code := callWithToken(handler, token); code != http.StatusForbidden {
+		t.Fatalf("expected 403 for ordinary user, got %d", code)
+	}
+
+	if err := SetRole(db, userID, RoleAdmin); err != nil {
+		t.Fatalf("failed to set role: %v", err)
+	}
+	// Смена роли отзывает старый токен.
+	if code := callWithToken(handler, token); code != http.StatusUnauthorized {
+		t.Fatalf("expected old token to be revoked after role change, got %d", code)
+	}
+	token, _ = loginUser(t, db, "promoted", "secret123")
+	if code := callWithToken(handler, token); code != http.StatusOK {
+		t.Fatalf("expected admin to pass, got %d", code)
+	}
+
+	if err := SetRole(db, userID, "superuser"); err == nil {
+		t.Fatal("expected unknown role to be rejected")
+	}
+}
+
+func TestLogin_ProgressiveLockout(t *testing.T) {
+	db := setupSQLTestDB(t)
+	registerUser(t, db, "victim", "secret123")
+
+	defer func(p LockoutPolicy) { Lockout = p }(Lockout)
+	Lockout = LockoutPolicy{Threshold: 3, BaseDuration: time.Minute, MaxDuration: time.Hour}
+
+	for i := 0; i < 3; i++ {
+		if _, code := loginUser(t, db, "victim", "wrong"); code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401, got %d", i, code)
+		}
+	}
+	// Даже верный пароль не принимается, пока логин заблокирован.
+	body := `{"login":"victim","password":"secret123"}`
+	w := postJSON(t, LoginHandler(db), "/api/v1/login", body)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 while locked out, got %d", w.Code)
+	}
+	if retryAfter, _ := strconv.Atoi(w.Header().Get("Retry-After")); retryAfter < 50 || retryAfter > 60 {
+		t.Fatalf("expected Retry-After about a minute, got %q", w.Header().Get("Retry-After"))
+	}
+
+	// Блокировка хранится в базе и переживает перезапуск.
+	var failures int
+	if err := db.QueryRow("SELECT failures FROM login_failures WHERE login = ?", "victim").Scan(&failures); err != nil {
+		t.Fatalf("failed to read login failures: %v", err)
+	}
+	if failures != 3 {
+		t.Fatalf("expected 3 recorded failures, got %d", failures)
+	}
+
+	if _, err := db.Exec("UPDATE login_failures SET locked_until = ? WHERE login = ?", time.Now().Add(-time.Second).Unix(), "victim"); err != nil {
+		t.Fatalf("failed to expire lockout: %v", err)
+	}
+	if _, code := loginUser(t, db, "victim", "secret123"); code != http.StatusOK {
+		t.Fatalf("expected login after lockout expiry, got %d", code)
+	}
+	if err := db.QueryRow("SELECT failures FROM login_failures WHERE login = ?", "victim").Scan(&failures); err != sql.ErrNoRows {
+		t.Fatalf("expected failures to reset after successful login, got %v", err)
+	}
+}
+
+func TestLockoutPolicyDuration(t *testing.T) {
+	p := LockoutPolicy{Threshold: 5, BaseDuration: time.Minute, MaxDuration: 10 * time.Minute}
+	cases := map[int]time.Duration{
+		4:  0,
+		5:  time.Minute,
+		6:  2 * time.Minute,
+		8:  8 * time.Minute,
+		9:  10 * time.Minute,
+		50: 10 * time.Minute,
+	}
+	for failures, want := range cases {
+		if got := p.duration(failures); got != want {
+			t.Fatalf("duration(%d) = %v, want %v", failures, got, want)
+		}
+	}
+}
+
+func TestLogin_UnknownLoginCountsAsFailure(t *testing.T) {
+	db := setupSQLTestDB(t)
+
+	if _, code := loginUser(t, db, "ghost", "whatever"); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for unknown login, got %d", code)
+	}
+	var failures int
+	if err := db.QueryRow("SELECT failures FROM login_failures WHERE login = ?", "ghost").Scan(&failures); err != nil || failures != 1 {
+		t.Fatalf("expected failure recorded for unknown login, got %d (%v)", failures, err)
+	}
+}
+
+func TestLogin_PrunesStaleFailures(t *testing.T) {
+	db := setupSQLTestDB(t)
+	lastPrune = time.Time{}
+
+	for _, login := range []string{"ghost", "phantom"} {
+		if _, code := loginUser(t, db, login, "whatever"); code != http.StatusUnauthorized {
+			t.Fatalf("expected 401 for unknown login, got %d", code)
+		}
+	}
+	if _, err := db.Exec("UPDATE login_failures SET updated_at = datetime('now', '-2 days')"); err != nil {
+		t.Fatalf("failed to age login failures: %v", err)
+	}
+
+	// Старый счётчик начинается заново, а не продолжается.
+	if _, code := loginUser(t, db, "ghost", "whatever"); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for unknown login, got %d", code)
+	}
+	var failures int
+	if err := db.QueryRow("SELECT failures FROM login_failures WHERE login = ?", "ghost").Scan(&failures); err != nil || failures != 1 {
+		t.Fatalf("expected stale counter to restart, got %d (%v)", failures, err)
+	}
+
+	lastPrune = time.Time{}
+	if _, code := loginUser(t, db, "ghost", "whatever"); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for unknown login, got %d", code)
+	}
+	if err := db.QueryRow("SELECT failures FROM login_failures WHERE login = ?", "phantom").Scan(&failures); err != sql.ErrNoRows {
+		t.Fatalf("expected stale login failures to be deleted, got %v", err)
+	}
+}
+
+func TestLogin_FailsWhenFailureNotRecorded(t *testing.T) {
+	db := setupSQLTestDB(t)
+	registerUser(t, db, "victim", "secret123")
+
+	// Без записи неудачи блокировка не работала бы, поэтому вход не продолжается.
+	_, err := db.Exec(`CREATE TRIGGER fail_login_failures BEFORE INSERT ON login_failures
+		BEGIN SELECT RAISE(ABORT, 'disk full'); END`)
+	if err != nil {
+		t.Fatalf("failed to create trigger: %v", err)
+	}
+	if _, code := loginUser(t, db, "victim", "wrong"); code != http.StatusInternalServerError {
+		t.Fatalf("expected 500 when failure cannot be recorded, got %d", code)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	db := setupSQLTestDB(t)
+	registerUser(t, db, "limited", "secret123")
+
+	LoginNameLimiter = NewRateLimiter(0.001, 2)
+	for i := 0; i < 2; i++ {
+		if _, code := loginUser(t, db, "limited", "secret123"); code != http.StatusOK {
+			t.Fatalf("attempt %d: expected 200, got %d", i, code)
+		}
+	}
+	if _, code := loginUser(t, db, "limited", "secret123"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 over per-login limit, got %d", code)
+	}
+
+	RegisterIPLimiter = NewRateLimiter(0.001, 1)
+	registerUser(t, db, "first", "secret123")
+	w := postJSON(t, RegisterHandler(db), "/api/v1/register", `{"login":"second","password":"secret123"}`)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 429 with Retry-After over registration limit, got %d", w.Code)
+	}
+}
+
+func TestRegister_ValidationErrors(t *testing.T) {
+	db := setupSQLTestDB(t)
+
+	w := postJSON(t, RegisterHandler(db), "/api/v1/register", `{"login":"bad login","password":"x"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	var resp struct {
+		Errors ValidationErrors `json:"errors"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode errors: %v", err)
+	}
+	if resp.Errors["login"] == "" || resp.Errors["password"] == "" {
+		t.Fatalf("expected errors for both fields, got %v", resp.Errors)
+	}
+
+	w = postJSON(t, RegisterHandler(db), "/api/v1/register", `{"login":"someone","password":"Password123"}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "too common") {
+		t.Fatalf("expected common password to be rejected, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRegister_LoginNormalization(t *testing.T) {
+	db := setupSQLTestDB(t)
+
+	registerUser(t, db, "  Alice ", "secret123")
+
+	var stored string
+	if err := db.QueryRow("SELECT login FROM users").Scan(&stored); err != nil {
+		t.Fatalf("failed to read login: %v", err)
+	}
+	if stored != "alice" {
+		t.Fatalf("expected normalized login 'alice', got %q", stored)
+	}
+
+	// Полноширинные символы после NFKC совпадают с обычными.
+	w := postJSON(t, RegisterHandler(db), "/api/v1/register", `{"login":"ＡＬＩＣＥ","password":"secret123"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected duplicate login to be rejected, got %d", w.Code)
+	}
+	if _, code := loginUser(t, db, "ALICE", "secret123"); code != http.StatusOK {
+		t.Fatalf("expected case-insensitive login, got %d", code)
+	}
+}
+
+func TestPasswordLongerThanBcryptLimit(t *testing.T) {
+	db := setupSQLTestDB(t)
+
+	long := strings.Repeat("a", 80) + "-tail"
+	registerUser(t, db, "longpass", long)
+
+	if _, code := loginUser(t, db, "longpass", long); code != http.StatusOK {
+		t.Fatalf("expected login with long password, got %d", code)
+	}
+	// Без предварительного хеширования bcrypt не увидел бы отличие после 72 байт.
+	if _, code := loginUser(t, db, "longpass", strings.Repeat("a", 80)+"-TAIL"); code != http.StatusUnauthorized {
+		t.Fatalf("expected different tail to be rejected, got %d", code)
+	}
+}
+
+func TestPrehashedPasswordDoesNotCollide(t *testing.T) {
+	db := setupSQLTestDB(t)
+
+	long := strings.Repeat("b", 80) + "-tail"
+	registerUser(t, db, "longpass", long)
+
+	// Знание несолёного SHA-256 длинного пароля не должно заменять сам пароль.
+	sum := sha256.Sum256([]byte(long))
+	digest := base64.StdEncoding.EncodeToString(sum[:])
+	if _, code := loginUser(t, db, "longpass", digest); code != http.StatusUnauthorized {
+		t.Fatalf("expected pre-hash digest to be rejected, got %d", code)
+	}
+	if bytes.Equal(prepareForBcrypt(digest), prepareForBcrypt(long)) {
+		t.Fatal("expected digest and long password to differ before bcrypt")
+	}
+}
+
+func TestLoadBlocklist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	if err := os.WriteFile(path, []byte("# comment\n\nCorrectHorse\n"), 0o600); err != nil {
+		t.Fatalf("failed to write blocklist: %v", err)
+	}
+	blocklist, err := LoadBlocklist(path)
+	if err != nil {
+		t.Fatalf("failed to load blocklist: %v", err)
+	}
+	policy := PasswordPolicy{MinLength: 8, Blocklist: blocklist}
+	if msg := policy.Validate("correcthorse", "user"); msg == "" {
+		t.Fatal("expected blocklisted password to be rejected")
+	}
+	if msg := policy.Validate("battery-staple", "user"); msg != "" {
+		t.Fatalf("expected password to pass, got %q", msg)
+	}
+}
+
+func createAPIKey(t *testing.T, db *sql.DB, token, body string) APIKey {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/api-keys", bytes.NewBufferString(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	JWTMiddleware(db, CreateAPIKeyHandler(db)).ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("failed to create api key: %d %s", w.Code, w.Body.String())
+	}
+	var key APIKey
+	if err := json.NewDecoder(w.Body).Decode(&key); err != nil {
+		t.Fatalf("failed to decode api key: %v", err)
+	}
+	return key
+}
+
+func callWithAPIKey(handler http.Handler, header, value string) int {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(header, value)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestAPIKeys(t *testing.T) {
+	db := setupSQLTestDB(t)
+	registerUser(t, db, "batchjob", "secret123")
+	token, _ := loginUser(t, db, "batchjob", "secret123")
+
+	key := createAPIKey(t, db, token, `{"name":"reports","scopes":["calculate"]}`)
+	if !strings.HasPrefix(key.Key, "dck_"+key.Prefix+"_") {
+		t.Fatalf("expected key to start with visible prefix, got %q", key.Key)
+	}
+	var stored string
+	if err := db.QueryRow("SELECT key_hash FROM api_keys WHERE id = ?", key.ID).Scan(&stored); err != nil || stored == key.Key {
+		t.Fatalf("expected key to be stored hashed, got %q (%v)", stored, err)
+	}
+
+	calculate := JWTMiddleware(db, okHandler, ScopeCalculate)
+	history := JWTMiddleware(db, okHandler, ScopeReadHistory)
+	sessionOnly := JWTMiddleware(db, okHandler)
+
+	if code := callWithAPIKey(calculate, APIKeyHeader, key.Key); code != http.StatusOK {
+		t.Fatalf("expected X-API-Key to pass, got %d", code)
+	}
+	if code := callWithAPIKey(calculate, "Authorization", "ApiKey "+key.Key); code != http.StatusOK {
+		t.Fatalf("expected Authorization: ApiKey to pass, got %d", code)
+	}
+	if code := callWithAPIKey(history, APIKeyHeader, key.Key); code != http.StatusForbidden {
+		t.Fatalf("expected 403 without read-history scope, got %d", code)
+	}
+	if code := callWithAPIKey(sessionOnly, APIKeyHeader, key.Key); code != http.StatusForbidden {
+		t.Fatalf("expected 403 on endpoint without scopes, got %d", code)
+	}
+	if code := callWithAPIKey(calculate, APIKeyHeader, key.Key+"x"); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for wrong key, got %d", code)
+	}
+
+	var lastUsed sql.NullString
+	if err := db.QueryRow("SELECT last_used_at FROM api_keys WHERE id = ?", key.ID).Scan(&lastUsed); err != nil || !lastUsed.Valid {
+		t.Fatalf("expected last_used_at to be set, got %v (%v)", lastUsed, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("DELETE /api/v1/api-keys/{id}", JWTMiddleware(db, RevokeAPIKeyHandler(db)))
+	req := httptest.NewRequest(http.MethodDelete, "/api/v1/api-keys/"+strconv.FormatInt(key.ID, 10), nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected revoke to succeed, got %d", w.Code)
+	}
+	if code := callWithAPIKey(calculate, APIKeyHeader, key.Key); code != http.StatusUnauthorized {
+		t.Fatalf("expected revoked key to be rejected, got %d", code)
+	}
+}
+
+func TestAPIKeys_Expired(t *testing.T) {
+	db := setupSQLTestDB(t)
+	registerUser(t, db, "expiring", "secret123")
+	token, _ := loginUser(t, db, "expiring", "secret123")
+
+	expiresAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	key := createAPIKey(t, db, token, `{"name":"short","expires_at":"`+expiresAt+`"}`)
+	if len(key.Scopes) != len(Scopes) {
+		t.Fatalf("expected all scopes by default, got %v", key.Scopes)
+	}
+
+	calculate := JWTMiddleware(db, okHandler, ScopeCalculate)
+	if code := callWithAPIKey(calculate, APIKeyHeader, key.Key); code != http.StatusOK {
+		t.Fatalf("expected unexpired key to pass, got %d", code)
+	}
+	if _, err := db.Exec("UPDATE api_keys SET expires_at = ? WHERE id = ?", time.Now().Add(-time.Minute).Unix(), key.ID); err != nil {
+		t.Fatalf("failed to expire key: %v", err)
+	}
+	if code := callWithAPIKey(calculate, APIKeyHeader, key.Key); code != http.StatusUnauthorized {
+		t.Fatalf("expected expired key to be rejected, got %d", code)
+	}
+}
+
+func callAccount(handler http.Handler, method, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/api/v1/me", bytes.NewBufferString(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestMe(t *testing.T) {
+	db := setupSQLTestDB(t)
+	id := registerUser(t, db, "Whoami", "secret123")
+	token, _ := loginUser(t, db, "whoami", "secret123")
+
+	w := callAccount(JWTMiddleware(db, MeHandler(db)), http.MethodGet, token, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var user UserSummary
+	json.NewDecoder(w.Body).Decode(&user)
+	if user.ID != id || user.Login != "whoami" || user.Role != RoleUser {
+		t.Fatalf("unexpected user %+v", user)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	db := setupSQLTestDB(t)
+	registerUser(t, db, "changer", "secret123")
+	token, _ := loginUser(t, db, "changer", "secret123")
+	other, _ := loginUser(t, db, "changer", "secret123")
+	handler := JWTMiddleware(db, ChangePasswordHandler(db))
+
+	w := callAccount(handler, http.MethodPost, token, `{"current_password":"wrong-one","new_password":"another-secret"}`)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for wrong current password, got %d", w.Code)
+	}
+	w = callAccount(handler, http.MethodPost, token, `{"current_password":"secret123","new_password":"short"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for weak new password, got %d", w.Code)
+	}
+
+	w = callAccount(handler, http.MethodPost, token, `{"current_password":"secret123","new_password":"another-secret"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", w.Code, w.Body.String())
+	}
+	var resp map[string]string
+	json.NewDecoder(w.Body).Decode(&resp)
+
+	protected := JWTMiddleware(db, okHandler)
+	if code := callWithToken(protected, resp["token"]); code != http.StatusOK {
+		t.Fatalf("expected new token to work, got %d", code)
+	}
+	for _, old := range []string{token, other} {
+		if code := callWithToken(protected, old); code != http.StatusUnauthorized {
+			t.Fatalf("expected old sessions to be revoked, got %d", code)
+		}
+	}
+	if _, code := loginUser(t, db, "changer", "secret123"); code != http.StatusUnauthorized {
+		t.Fatalf("expected old password to be rejected, got %d", code)
+	}
+	if _, code := loginUser(t, db, "changer", "another-secret"); code != http.StatusOK {
+		t.Fatalf("expected new password to work, got %d", code)
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	db := setupSQLTestDB(t)
+	id := registerUser(t, db, "leaver", "secret123")
+	keep := registerUser(t, db, "stayer", "secret123")
+	token, _ := loginUser(t, db, "leaver", "secret123")
+	createAPIKey(t, db, token, `{"name":"ci"}`)
+	for _, userID := range []int64{id, keep} {
+		if _, err := db.Exec("INSERT INTO calculations (user_id, expression, result, created_at) VALUES (?, '2+2', '4', CURRENT_TIMESTAMP)", userID); err != nil {
+			t.Fatalf("failed to insert calculation: %v", err)
+		}
+	}
+	handler := JWTMiddleware(db, DeleteAccountHandler(db))
+
+	if w := callAccount(handler, http.MethodDelete, token, `{"password":"wrong-one"}`); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for wrong password, got %d", w.Code)
+	}
+	if w := callAccount(handler, http.MethodDelete, token, `{"password":"secret123"}`); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d %s", w.Code, w.Body.String())
+	}
+
+	for _, table := range []string{"users", "calculations", "api_keys"} {
+		column := "user_id"
+		if table == "users" {
+			column = "id"
+		}
+		var count int
+		db.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE "+column+" = ?", id).Scan(&count)
+		if count != 0 {
+			t.Fatalf("expected %s rows of deleted user to be removed, got %d", table, count)
+		}
+	}
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM calculations WHERE user_id = ?", keep).Scan(&count)
+	if count != 1 {
+		t.Fatalf("expected other users' calculations to stay, got %d", count)
+	}
+	if code := callWithToken(JWTMiddleware(db, okHandler), token); code != http.StatusUnauthorized {
+		t.Fatalf("expected token of deleted user to be rejected, got %d", code)
+	}
+}
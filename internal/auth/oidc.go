@@ -0,0 +1,482 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	oidcStateCookie = "oidc_state"
+	oidcStateTTL    = 10 * time.Minute
+	oidcMaxPending  = 10000
+	oidcMaxResponse = 1 << 20
+	// Хеш, который не совпадёт ни с одним паролем: пользователи из SSO
+	// входят только через провайдера.
+	unusablePasswordHash = "!"
+)
+
+type OIDCConfig struct {
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+}
+
+// OIDCConfigFromEnv читает OIDC_ISSUER_URL, OIDC_CLIENT_ID, OIDC_CLIENT_SECRET
+// и OIDC_REDIRECT_URL. ok == false, если SSO не настроен.
+func OIDCConfigFromEnv() (OIDCConfig, bool) {
+	cfg := OIDCConfig{
+		IssuerURL:    os.Getenv("OIDC_ISSUER_URL"),
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+	}
+	return cfg, cfg.IssuerURL != "" && cfg.ClientID != "" && cfg.RedirectURL != ""
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcPending struct {
+	nonce     string
+	verifier  string
+	expiresAt time.Time
+}
+
+type idTokenClaims struct {
+	Nonce             string `json:"nonce"`
+	Email             string `json:"email"`
+	PreferredUsername string `json:"preferred_username"`
+	jwt.RegisteredClaims
+}
+
+// OIDCProvider выполняет authorization code flow с PKCE. Discovery-документ
+// и ключи провайдера загружаются при первом входе, а не при старте сервиса.
+type OIDCProvider struct {
+	config OIDCConfig
+	client *http.Client
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+	pending     map[string]oidcPending
+}
+
+func NewOIDCProvider(cfg OIDCConfig) *OIDCProvider {
+	cfg.IssuerURL = strings.TrimSuffix(cfg.IssuerURL, "/")
+	return &OIDCProvider{
+		config:  cfg,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		pending: make(map[string]oidcPending),
+	}
+}
+
+var oidcProvider *OIDCProvider
+
+func InitOIDC(p *OIDCProvider) {
+	oidcProvider = p
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, endpoint string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: unexpected status %d", endpoint, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, oidcMaxResponse)).Decode(v)
+}
+
+func (p *OIDCProvider) getDiscovery(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	d := p.discovery
+	p.mu.Unlock()
+	if d != nil {
+		return d, nil
+	}
+	d = &oidcDiscovery{}
+	if err := p.getJSON(ctx, p.config.IssuerURL+"/.well-known/openid-configuration", d); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != p.config.IssuerURL {
+		return nil, fmt.Errorf("discovery issuer %q does not match %q", d.Issuer, p.config.IssuerURL)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("incomplete discovery document")
+	}
+	p.mu.Lock()
+	p.discovery = d
+	p.mu.Unlock()
+	return d, nil
+}
+
+// publicKey возвращает ключ по kid. Неизвестный kid означает ротацию ключей
+// у провайдера, поэтому JWKS перечитывается, но не чаще раза в минуту.
+func (p *OIDCProvider) publicKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	stale := time.Since(p.keysFetched) > time.Minute
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(ctx, d.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) > 4 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	p.mu.Lock()
+	p.keys = keys
+	p.keysFetched = time.Now()
+	p.mu.Unlock()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// begin запоминает state, nonce и PKCE verifier и возвращает адрес
+// страницы входа провайдера.
+func (p *OIDCProvider) begin(ctx context.Context) (authURL, state string, err error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	state, err = randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	p.mu.Lock()
+	now := time.Now()
+	if len(p.pending) >= oidcMaxPending {
+		for s, pending := range p.pending {
+			if now.After(pending.expiresAt) {
+				delete(p.pending, s)
+			}
+		}
+	}
+	if len(p.pending) >= oidcMaxPending {
+		p.mu.Unlock()
+		return "", "", errors.New("too many pending logins")
+	}
+	p.pending[state] = oidcPending{nonce: nonce, verifier: verifier, expiresAt: now.Add(oidcStateTTL)}
+	p.mu.Unlock()
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {"openid profile email"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + query.Encode(), state, nil
+}
+
+// takePending забирает данные входа по state. Каждый state одноразовый.
+func (p *OIDCProvider) takePending(state string) (oidcPending, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pending, ok := p.pending[state]
+	delete(p.pending, state)
+	if !ok || time.Now().After(pending.expiresAt) {
+		return oidcPending{}, false
+	}
+	return pending, true
+}
+
+// exchange меняет code на ID token и проверяет его подпись и claims.
+func (p *OIDCProvider) exchange(ctx context.Context, code string, pending oidcPending) (*idTokenClaims, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"code_verifier": {pending.verifier},
+		"client_id":     {p.config.ClientID},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint: unexpected status %d", resp.StatusCode)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, oidcMaxResponse)).Decode(&tokens); err != nil {
+		return nil, err
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("token response without id_token")
+	}
+
+	claims := &idTokenClaims{}
+	_, err = jwt.ParseWithClaims(tokens.IDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.publicKey(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256"}),
+		jwt.WithIssuer(d.Issuer),
+		jwt.WithAudience(p.config.ClientID),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(pending.nonce)) != 1 {
+		return nil, errors.New("nonce mismatch")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("id token without subject")
+	}
+	return claims, nil
+}
+
+// userForIdentity находит пользователя, привязанного к (issuer, sub), или
+// создаёт нового. Существующие учётные записи по совпадению логина или email
+// не привязываются: иначе провайдер мог бы войти в чужой аккаунт.
+func userForIdentity(ctx context.Context, db *sql.DB, issuer string, claims *idTokenClaims) (User, error) {
+	var user User
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return user, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx,
+		`SELECT u.id, u.login, u.role, u.disabled, u.token_version
+		FROM user_identities i JOIN users u ON u.id = i.user_id
+		WHERE i.issuer = ? AND i.subject = ?`,
+		issuer, claims.Subject,
+	).Scan(&user.ID, &user.Login, &user.Role, &user.Disabled, &user.TokenVersion)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return user, err
+	}
+
+	login, err := provisionedLogin(ctx, tx, issuer, claims)
+	if err != nil {
+		return user, err
+	}
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO users (login, password_hash) VALUES (?, ?) RETURNING id, login, role, disabled, token_version",
+		login, unusablePasswordHash,
+	).Scan(&user.ID, &user.Login, &user.Role, &user.Disabled, &user.TokenVersion)
+	if err != nil {
+		return user, err
+	}
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO user_identities (issuer, subject, user_id, created_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP)",
+		issuer, claims.Subject, user.ID,
+	)
+	if err != nil {
+		return user, err
+	}
+	return user, tx.Commit()
+}
+
+// provisionedLogin выбирает логин для нового пользователя: preferred_username,
+// затем email, а если оба заняты или не подходят - имя из хеша sub.
+func provisionedLogin(ctx context.Context, tx *sql.Tx, issuer string, claims *idTokenClaims) (string, error) {
+	sum := sha256.Sum256([]byte(issuer + "\x00" + claims.Subject))
+	fallback := "sso-" + hex.EncodeToString(sum[:6])
+	for _, candidate := range []string{claims.PreferredUsername, claims.Email, fallback} {
+		login := NormalizeLogin(candidate)
+		if ValidateLogin(login) != "" {
+			continue
+		}
+		var exists bool
+		err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE login = ? COLLATE NOCASE)", login).Scan(&exists)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return login, nil
+		}
+	}
+	return "", errors.New("no free login for identity")
+}
+
+func OIDCLoginHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := oidcProvider
+		if p == nil {
+			http.Error(w, "sso not configured", http.StatusNotFound)
+			return
+		}
+		authURL, state, err := p.begin(r.Context())
+		if err != nil {
+			http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+			return
+		}
+		// Cookie привязывает state к браузеру, начавшему вход.
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcStateCookie,
+			Value:    state,
+			Path:     "/api/v1/auth/oidc",
+			MaxAge:   int(oidcStateTTL.Seconds()),
+			HttpOnly: true,
+			Secure:   strings.HasPrefix(p.config.RedirectURL, "https://"),
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, authURL, http.StatusFound)
+	}
+}
+
+func OIDCCallbackHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := oidcProvider
+		if p == nil {
+			http.Error(w, "sso not configured", http.StatusNotFound)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/api/v1/auth/oidc", MaxAge: -1})
+
+		query := r.URL.Query()
+		state := query.Get("state")
+		cookie, err := r.Cookie(oidcStateCookie)
+		if state == "" || err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+			http.Error(w, "invalid state", http.StatusBadRequest)
+			return
+		}
+		pending, ok := p.takePending(state)
+		if !ok {
+			http.Error(w, "invalid state", http.StatusBadRequest)
+			return
+		}
+		if msg := query.Get("error"); msg != "" {
+			http.Error(w, "authorization failed: "+msg, http.StatusUnauthorized)
+			return
+		}
+		code := query.Get("code")
+		if code == "" {
+			http.Error(w, "missing code", http.StatusBadRequest)
+			return
+		}
+
+		claims, err := p.exchange(r.Context(), code, pending)
+		if err != nil {
+			http.Error(w, "invalid id token", http.StatusUnauthorized)
+			return
+		}
+		user, err := userForIdentity(r.Context(), db, p.config.IssuerURL, claims)
+		if err != nil {
+			http.Error(w, "failed to provision user", http.StatusInternalServerError)
+			return
+		}
+		if user.Disabled {
+			http.Error(w, "account disabled", http.StatusForbidden)
+			return
+		}
+		tokenString, err := issueToken(user)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"token": tokenString})
+	}
+}
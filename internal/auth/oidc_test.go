@@ -0,0 +1,350 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// fakeOIDC - минимальный провайдер: discovery, JWKS, authorize без
+// формы входа и token endpoint с проверкой PKCE.
+type fakeOIDC struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu       sync.Mutex
+	signKey  *rsa.PrivateKey
+	codes    map[string]fakeCode
+	subject  string
+	username string
+	email    string
+	nonce    string
+}
+
+type fakeCode struct {
+	challenge, nonce, redirectURI string
+}
+
+const (
+	fakeClientID     = "calc-service"
+	fakeClientSecret = "calc-secret"
+)
+
+func newFakeOIDC(t *testing.T) *fakeOIDC {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	f := &fakeOIDC{key: key, signKey: key, codes: make(map[string]fakeCode), subject: "sub-1", username: "Alice"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 f.server.URL,
+			"authorization_endpoint": f.server.URL + "/authorize",
+			"token_endpoint":         f.server.URL + "/token",
+			"jwks_uri":               f.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "key-1",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("GET /authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("client_id") != fakeClientID || q.Get("code_challenge_method") != "S256" || q.Get("response_type") != "code" {
+			http.Error(w, "bad authorize request", http.StatusBadRequest)
+			return
+		}
+		code := "code-" + q.Get("state")
+		f.mu.Lock()
+		f.codes[code] = fakeCode{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), redirectURI: q.Get("redirect_uri")}
+		f.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, ok := r.BasicAuth(); !ok || id != fakeClientID || secret != fakeClientSecret {
+			http.Error(w, "invalid_client", http.StatusUnauthorized)
+			return
+		}
+		f.mu.Lock()
+		code, ok := f.codes[r.FormValue("code")]
+		delete(f.codes, r.FormValue("code"))
+		f.mu.Unlock()
+		if !ok || r.FormValue("grant_type") != "authorization_code" || r.FormValue("redirect_uri") != code.redirectURI ||
+			pkceChallenge(r.FormValue("code_verifier")) != code.challenge {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		nonce := code.nonce
+		if f.nonce != "" {
+			nonce = f.nonce
+		}
+		claims := idTokenClaims{
+			Nonce:             nonce,
+			Email:             f.email,
+			PreferredUsername: f.username,
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    f.server.URL,
+				Subject:   f.subject,
+				Audience:  jwt.ClaimStrings{fakeClientID},
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+				IssuedAt:  jwt.NewNumericDate(time.Now()),
+			},
+		}
+		signKey := f.signKey
+		f.mu.Unlock()
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "key-1"
+		idToken, err := token.SignedString(signKey)
+		if err != nil {
+			http.Error(w, "server_error", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "at", "token_type": "Bearer", "id_token": idToken})
+	})
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+
+	InitOIDC(NewOIDCProvider(OIDCConfig{
+		IssuerURL:    f.server.URL,
+		ClientID:     fakeClientID,
+		ClientSecret: fakeClientSecret,
+		RedirectURL:  "http://calc.test/api/v1/auth/oidc/callback",
+	}))
+	t.Cleanup(func() { InitOIDC(nil) })
+	return f
+}
+
+// startOIDCLogin проходит шаги до возврата из провайдера и возвращает
+// запрос к callback вместе с cookie.
+func startOIDCLogin(t *testing.T, f *fakeOIDC) *http.Request {
+	t.Helper()
+	w := httptest.NewRecorder()
+	OIDCLoginHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/auth/oidc/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected redirect to provider, got %d %s", w.Code, w.Body.String())
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("authorize request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected provider to redirect back, got %d", resp.StatusCode)
+	}
+	req := httptest.NewRequest(http.MethodGet, resp.Header.Get("Location"), nil)
+	for _, cookie := range w.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	return req
+}
+
+func finishOIDCLogin(db *sql.DB, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	OIDCCallbackHandler(db).ServeHTTP(w, req)
+	return w
+}
+
+func tokenUserID(t *testing.T, w *httptest.ResponseRecorder) int64 {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 from callback, got %d %s", w.Code, w.Body.String())
+	}
+	var resp map[string]string
+	json.NewDecoder(w.Body).Decode(&resp)
+	claims, err := ParseToken(resp["token"])
+	if err != nil {
+		t.Fatalf("callback returned invalid token: %v", err)
+	}
+	return claims.UserID
+}
+
+func TestOIDCLogin_ProvisionsAndLinksBySubject(t *testing.T) {
+	db := setupSQLTestDB(t)
+	f := newFakeOIDC(t)
+
+	userID := tokenUserID(t, finishOIDCLogin(db, startOIDCLogin(t, f)))
+	var login, role string
+	if err := db.QueryRow("SELECT login, role FROM users WHERE id = ?", userID).Scan(&login, &role); err != nil {
+		t.Fatalf("failed to load provisioned user: %v", err)
+	}
+	if login != "alice" || role != RoleUser {
+		t.Fatalf("unexpected provisioned user %q/%q", login, role)
+	}
+
+	// Смена имени у провайдера не создаёт нового пользователя.
+	f.mu.Lock()
+	f.username = "alice.renamed"
+	f.mu.Unlock()
+	if again := tokenUserID(t, finishOIDCLogin(db, startOIDCLogin(t, f))); again != userID {
+		t.Fatalf("expected same user for same subject, got %d and %d", userID, again)
+	}
+	var identities int
+	db.QueryRow("SELECT COUNT(*) FROM user_identities").Scan(&identities)
+	if identities != 1 {
+		t.Fatalf("expected one linked identity, got %d", identities)
+	}
+
+	if _, code := loginUser(t, db, "alice", unusablePasswordHash); code != http.StatusUnauthorized {
+		t.Fatalf("expected password login to fail for SSO user, got %d", code)
+	}
+}
+
+func TestLogin_SSOUserTakesAsLongAsUnknownLogin(t *testing.T) {
+	db := setupSQLTestDB(t)
+	f := newFakeOIDC(t)
+	tokenUserID(t, finishOIDCLogin(db, startOIDCLogin(t, f)))
+
+	compareDummyPassword("warm-up")
+	start := time.Now()
+	compareDummyPassword("whatever")
+	dummy := time.Since(start)
+
+	// Без проверки bcrypt отказ для пользователя из SSO приходил бы за микросекунды.
+	start = time.Now()
+	if _, code := loginUser(t, db, "alice", "whatever"); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for SSO user, got %d", code)
+	}
+	if elapsed := time.Since(start); elapsed < dummy/2 {
+		t.Fatalf("expected SSO login failure to take about a bcrypt check (%v), took %v", dummy, elapsed)
+	}
+}
+
+func TestOIDCLogin_DoesNotLinkLocalAccountByLogin(t *testing.T) {
+	db := setupSQLTestDB(t)
+	local := registerUser(t, db, "alice", "secret123")
+	f := newFakeOIDC(t)
+	f.mu.Lock()
+	f.email = "alice@example.com"
+	f.mu.Unlock()
+
+	userID := tokenUserID(t, finishOIDCLogin(db, startOIDCLogin(t, f)))
+	if userID == local {
+		t.Fatal("expected SSO identity not to take over local account")
+	}
+	var login string
+	db.QueryRow("SELECT login FROM users WHERE id = ?", userID).Scan(&login)
+	if login != "alice@example.com" {
+		t.Fatalf("expected login from email, got %q", login)
+	}
+}
+
+func TestOIDCCallback_RejectsInvalidResponses(t *testing.T) {
+	db := setupSQLTestDB(t)
+	f := newFakeOIDC(t)
+
+	req := startOIDCLogin(t, f)
+	req.Header.Del("Cookie")
+	if w := finishOIDCLogin(db, req); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without state cookie, got %d", w.Code)
+	}
+
+	req = startOIDCLogin(t, f)
+	replay := req.Clone(req.Context())
+	tokenUserID(t, finishOIDCLogin(db, req))
+	if w := finishOIDCLogin(db, replay); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for reused state, got %d", w.Code)
+	}
+
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	f.mu.Lock()
+	f.signKey = other
+	f.mu.Unlock()
+	if w := finishOIDCLogin(db, startOIDCLogin(t, f)); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for foreign signature, got %d", w.Code)
+	}
+
+	f.mu.Lock()
+	f.signKey = f.key
+	f.nonce = "replayed-nonce"
+	f.mu.Unlock()
+	if w := finishOIDCLogin(db, startOIDCLogin(t, f)); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for nonce mismatch, got %d", w.Code)
+	}
+	f.mu.Lock()
+	f.nonce = ""
+	f.mu.Unlock()
+
+	req = startOIDCLogin(t, f)
+	f.mu.Lock()
+	for code, c := range f.codes {
+		c.challenge = pkceChallenge("some-other-verifier")
+		f.codes[code] = c
+	}
+	f.mu.Unlock()
+	if w := finishOIDCLogin(db, req); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 when PKCE verifier does not match, got %d", w.Code)
+	}
+}
+
+func TestOIDC_NotConfigured(t *testing.T) {
+	db := setupSQLTestDB(t)
+	w := httptest.NewRecorder()
+	OIDCLoginHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/auth/oidc/login", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without SSO config, got %d", w.Code)
+	}
+	if w := finishOIDCLogin(db, httptest.NewRequest(http.MethodGet, "/api/v1/auth/oidc/callback", nil)); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without SSO config, got %d", w.Code)
+	}
+}
+
+func TestOIDCUser_ConfirmsWithRecentSignIn(t *testing.T) {
+	db := setupSQLTestDB(t)
+	f := newFakeOIDC(t)
+
+	w := finishOIDCLogin(db, startOIDCLogin(t, f))
+	var resp map[string]string
+	json.NewDecoder(w.Body).Decode(&resp)
+	claims, err := ParseToken(resp["token"])
+	if err != nil {
+		t.Fatalf("callback returned invalid token: %v", err)
+	}
+
+	if w := callAccount(JWTMiddleware(db, ChangePasswordHandler(db)), http.MethodPost, resp["token"], `{"new_password":"brand-new-pass"}`); w.Code != http.StatusForbidden {
+		t.Fatalf("expected SSO user not to set a password, got %d", w.Code)
+	}
+
+	// Старый токен не подтверждает действие без пароля.
+	claims.IssuedAt = jwt.NewNumericDate(time.Now().Add(-ReauthWindow - time.Minute))
+	stale, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	if w := callAccount(JWTMiddleware(db, DeleteAccountHandler(db)), http.MethodDelete, stale, `{}`); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for stale session, got %d", w.Code)
+	}
+
+	if w := callAccount(JWTMiddleware(db, EnrollTOTPHandler(db)), http.MethodPost, resp["token"], `{}`); w.Code != http.StatusOK {
+		t.Fatalf("expected SSO user to enrol 2fa after recent sign-in, got %d %s", w.Code, w.Body.String())
+	}
+	if w := callAccount(JWTMiddleware(db, DeleteAccountHandler(db)), http.MethodDelete, resp["token"], `{}`); w.Code != http.StatusNoContent {
+		t.Fatalf("expected SSO user to delete account after recent sign-in, got %d %s", w.Code, w.Body.String())
+	}
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", claims.UserID).Scan(&count)
+	if count != 0 {
+		t.Fatal("expected SSO user to be deleted")
+	}
+}
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/text/unicode/norm"
+)
+
+// bcrypt учитывает только первые 72 байта пароля.
+const bcryptMaxBytes = 72
+
+const maxLoginLength = 64
+
+//go:embed common_passwords.txt
+var commonPasswords string
+
+type PasswordPolicy struct {
+	MinLength int // в символах
+	MaxLength int // в байтах, защищает от дорогого хеширования огромных строк
+	Blocklist map[string]struct{}
+}
+
+var Policy = PasswordPolicy{
+	MinLength: 8,
+	MaxLength: 1024,
+	Blocklist: mustParseBlocklist(strings.NewReader(commonPasswords)),
+}
+
+// ValidationErrors - ошибки по полям запроса: {"errors": {"password": "..."}}.
+type ValidationErrors map[string]string
+
+// LoadBlocklist читает список запрещённых паролей: по одному в строке,
+// пустые строки и строки с # пропускаются.
+func LoadBlocklist(path string) (map[string]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseBlocklist(f)
+}
+
+func parseBlocklist(r io.Reader) (map[string]struct{}, error) {
+	blocklist := make(map[string]struct{})
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		blocklist[strings.ToLower(line)] = struct{}{}
+	}
+	return blocklist, scanner.Err()
+}
+
+func mustParseBlocklist(r io.Reader) map[string]struct{} {
+	blocklist, err := parseBlocklist(r)
+	if err != nil {
+		panic(err)
+	}
+	return blocklist
+}
+
+// NormalizeLogin приводит логин к каноническому виду: без пробелов по краям,
+// в форме NFKC и в нижнем регистре.
+func NormalizeLogin(login string) string {
+	return strings.ToLower(norm.NFKC.String(strings.TrimSpace(login)))
+}
+
+// ValidateLogin проверяет уже нормализованный логин.
+func ValidateLogin(login string) string {
+	switch {
+	case login == "":
+		return "login required"
+	case utf8.RuneCountInString(login) > maxLoginLength:
+		return "login must be at most 64 characters"
+	case strings.IndexFunc(login, func(r rune) bool { return unicode.IsSpace(r) || !unicode.IsPrint(r) }) >= 0:
+		return "login must not contain spaces or control characters"
+	}
+	return ""
+}
+
+func (p PasswordPolicy) Validate(password, login string) string {
+	switch {
+	case password == "":
+		return "password required"
+	case utf8.RuneCountInString(password) < p.MinLength:
+		return "password is too short"
+	case p.MaxLength > 0 && len(password) > p.MaxLength:
+		return "password is too long"
+	case strings.EqualFold(password, login):
+		return "password must not match login"
+	}
+	if _, blocked := p.Blocklist[strings.ToLower(password)]; blocked {
+		return "password is too common"
+	}
+	return ""
+}
+
+func validateCredentials(login, password string) ValidationErrors {
+	errs := ValidationErrors{}
+	if msg := ValidateLogin(login); msg != "" {
+		errs["login"] = msg
+	}
+	if msg := Policy.Validate(password, login); msg != "" {
+		errs["password"] = msg
+	}
+	return errs
+}
+
+func writeValidationErrors(w http.ResponseWriter, errs ValidationErrors) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]ValidationErrors{"errors": errs})
+}
+
+// prehashMarker начинает свёрнутый пароль. Байт 0xFF не встречается в UTF-8,
+// поэтому свёртка не совпадёт ни с одним паролем, переданным как есть:
+// иначе строка base64(sha256(X)) подходила бы вместо длинного пароля X.
+const prehashMarker = "\xff"
+
+// prepareForBcrypt сворачивает пароли длиннее 72 байт в SHA-256, чтобы
+// bcrypt не отбрасывал их хвост. Короткие пароли передаются как есть, поэтому
+// старые хеши остаются рабочими.
+func prepareForBcrypt(password string) []byte {
+	if len(password) <= bcryptMaxBytes && utf8.ValidString(password) {
+		return []byte(password)
+	}
+	sum := sha256.Sum256([]byte(password))
+	return []byte(prehashMarker + base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(prepareForBcrypt(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func comparePassword(hash, password string) error {
+	// bcrypt сразу отклоняет короткий хеш; по быстрому отказу было бы видно,
+	// что логин принадлежит пользователю из SSO.
+	if hash == unusablePasswordHash {
+		compareDummyPassword(password)
+		return bcrypt.ErrMismatchedHashAndPassword
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), prepareForBcrypt(password))
+}
@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const maxBuckets = 10000
+
+// RateLimiter - набор token bucket по произвольному ключу (IP, логин).
+type RateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter создаёт ограничитель: rate токенов в секунду, не больше burst подряд.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+// Allow забирает токен для key. Если токенов нет, возвращает время до следующего.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.prune(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// prune удаляет полностью восстановившиеся корзины: они ничем не отличаются от новых.
+func (l *RateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+var (
+	LoginIPLimiter    = NewRateLimiter(1, 20)
+	LoginNameLimiter  = NewRateLimiter(0.1, 5)
+	RegisterIPLimiter = NewRateLimiter(1.0/60, 5)
+)
+
+// LockoutPolicy: после Threshold неудачных входов подряд логин блокируется
+// на BaseDuration, и каждая следующая неудача удваивает срок до MaxDuration.
+type LockoutPolicy struct {
+	Threshold    int
+	BaseDuration time.Duration
+	MaxDuration  time.Duration
+}
+
+var Lockout = LockoutPolicy{Threshold: 5, BaseDuration: time.Minute, MaxDuration: time.Hour}
+
+func (p LockoutPolicy) duration(failures int) time.Duration {
+	if failures < p.Threshold {
+		return 0
+	}
+	d := p.BaseDuration
+	for i := p.Threshold; i < failures && d < p.MaxDuration; i++ {
+		d *= 2
+	}
+	return min(d, p.MaxDuration)
+}
+
+// lockedFor возвращает, сколько ещё заблокирован вход для логина.
+func lockedFor(db *sql.DB, login string) (time.Duration, error) {
+	var lockedUntil sql.NullInt64
+	err := db.QueryRow("SELECT locked_until FROM login_failures WHERE login = ?", login).Scan(&lockedUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil || !lockedUntil.Valid {
+		return 0, err
+	}
+	return time.Until(time.Unix(lockedUntil.Int64, 0)), nil
+}
+
+// FailureRetention - через сколько без новых попыток счётчик неудач
+// забывается. Иначе неудачи для несуществующих логинов копились бы вечно.
+var FailureRetention = 24 * time.Hour
+
+// Забытые счётчики всех логинов удаляются не чаще раза в pruneInterval.
+const pruneInterval = time.Minute
+
+var (
+	pruneMu   sync.Mutex
+	lastPrune time.Time
+)
+
+func failureRetentionModifier() string {
+	return fmt.Sprintf("-%d seconds", int(FailureRetention.Seconds()))
+}
+
+func pruneLoginFailures(db *sql.DB) {
+	pruneMu.Lock()
+	if time.Since(lastPrune) < pruneInterval {
+		pruneMu.Unlock()
+		return
+	}
+	lastPrune = time.Now()
+	pruneMu.Unlock()
+
+	_, err := db.Exec(
+		"DELETE FROM login_failures WHERE updated_at < datetime('now', ?) AND (locked_until IS NULL OR locked_until < ?)",
+		failureRetentionModifier(), time.Now().Unix(),
+	)
+	if err != nil {
+		log.Printf("auth: failed to delete stale login failures: %v", err)
+	}
+}
+
+func recordLoginFailure(db *sql.DB, login string) error {
+	pruneLoginFailures(db)
+	var failures int
+	err := db.QueryRow(
+		`INSERT INTO login_failures (login, failures, updated_at) VALUES (?, 1, CURRENT_TIMESTAMP)
+		ON CONFLICT(login) DO UPDATE SET
+			failures = CASE WHEN updated_at < datetime('now', ?) AND (locked_until IS NULL OR locked_until < ?) THEN 1 ELSE failures + 1 END,
+			updated_at = CURRENT_TIMESTAMP
+		RETURNING failures`,
+		login, failureRetentionModifier(), time.Now().Unix(),
+	).Scan(&failures)
+	if err != nil {
+		return err
+	}
+	if d := Lockout.duration(failures); d > 0 {
+		_, err = db.Exec("UPDATE login_failures SET locked_until = ? WHERE login = ?", time.Now().Add(d).Unix(), login)
+	}
+	return err
+}
+
+func resetLoginFailures(db *sql.DB, login string) error {
+	_, err := db.Exec("DELETE FROM login_failures WHERE login = ?", login)
+	return err
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// compareDummyPassword тратит столько же времени, сколько проверка настоящего
+// пароля, чтобы по времени ответа нельзя было узнать, существует ли логин.
+func compareDummyPassword(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, prepareForBcrypt(password))
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func tooManyRequests(w http.ResponseWriter, message string, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, message, http.StatusTooManyRequests)
+}
@@ -0,0 +1,389 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Параметры TOTP по RFC 6238 в варианте, который понимают все приложения-
+// аутентификаторы: SHA-1, 6 цифр, шаг 30 секунд.
+const (
+	totpIssuer  = "DistributedCalculator"
+	totpDigits  = 6
+	totpPeriod  = 30
+	totpSkew    = 1
+	mfaAudience = "mfa"
+	mfaTokenTTL = 5 * time.Minute
+
+	recoveryCodeCount = 10
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type EnrollTOTPRequest struct {
+	Password string `json:"password"`
+}
+
+type EnrollTOTPResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+type ConfirmTOTPRequest struct {
+	Code string `json:"code"`
+}
+
+type LoginTOTPRequest struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// totpCode вычисляет код HOTP (RFC 4226) для номера шага.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits)))
+}
+
+// matchTOTP проверяет код с допуском в один шаг в обе стороны на
+// расхождение часов и возвращает шаг, которому код соответствует.
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := base32NoPadding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// useTOTP принимает код, только если его шаг новее последнего принятого:
+// один и тот же код нельзя использовать дважды.
+func useTOTP(ctx context.Context, db *sql.DB, userID int64, secret, code string) (bool, error) {
+	step, ok := matchTOTP(secret, strings.TrimSpace(code), time.Now())
+	if !ok {
+		return false, nil
+	}
+	res, err := db.ExecContext(ctx,
+		"UPDATE users SET totp_last_step = ? WHERE id = ? AND (totp_last_step IS NULL OR totp_last_step < ?)",
+		step, userID, step,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+func totpURI(login, secret string) string {
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {totpIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	label := url.PathEscape(totpIssuer + ":" + login)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// replaceRecoveryCodes выпускает новый набор кодов восстановления вместо
+// прежнего. В базе хранятся только хеши.
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int64) ([]string, error) {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		buf := make([]byte, 7)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32NoPadding.EncodeToString(buf))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		_, err := tx.ExecContext(ctx,
+			"INSERT INTO recovery_codes (user_id, code_hash, created_at) VALUES (?, ?, CURRENT_TIMESTAMP)",
+			userID, hashRecoveryCode(code),
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+func useRecoveryCode(ctx context.Context, db *sql.DB, userID int64, code string) (bool, error) {
+	res, err := db.ExecContext(ctx,
+		"UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		userID, hashRecoveryCode(code),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// issueMFAToken выдаёт токен второго шага входа. У него своя audience,
+// поэтому ParseToken и JWTMiddleware не принимают его как сессию.
+func issueMFAToken(user User) (string, error) {
+	claims := &Claims{
+		UserID:       user.ID,
+		TokenVersion: user.TokenVersion,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{mfaAudience},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(mfaTokenTTL)),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(jwtSecret)
+}
+
+func parseMFAToken(tokenStr string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	}, jwt.WithValidMethods([]string{"HS256"}), jwt.WithAudience(mfaAudience), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// ResetTOTP отключает второй фактор и удаляет коды восстановления.
+func ResetTOTP(db *sql.DB, userID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("UPDATE users SET totp_secret = NULL, totp_enabled = 0, totp_last_step = NULL WHERE id = ?", userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// EnrollTOTPHandler создаёт новый секрет. Второй фактор включается только
+// после подтверждения кодом из приложения.
+func EnrollTOTPHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req EnrollTOTPRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		user, ok := checkCurrentPassword(w, r, db, req.Password)
+		if !ok {
+			return
+		}
+		if user.TOTPEnabled {
+			http.Error(w, "2fa already enabled", http.StatusConflict)
+			return
+		}
+		buf := make([]byte, 20)
+		if _, err := rand.Read(buf); err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		secret := base32NoPadding.EncodeToString(buf)
+		_, err := db.ExecContext(r.Context(), "UPDATE users SET totp_secret = ?, totp_last_step = NULL WHERE id = ? AND totp_enabled = 0", secret, user.ID)
+		if err != nil {
+			http.Error(w, "failed to save 2fa secret", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(EnrollTOTPResponse{Secret: secret, URI: totpURI(user.Login, secret)})
+	}
+}
+
+// ConfirmTOTPHandler включает второй фактор и один раз показывает коды
+// восстановления.
+func ConfirmTOTPHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := UserIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req ConfirmTOTPRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		var secret sql.NullString
+		var enabled bool
+		err := db.QueryRowContext(r.Context(), "SELECT totp_secret, totp_enabled FROM users WHERE id = ?", userID).Scan(&secret, &enabled)
+		if err != nil {
+			http.Error(w, "user not found", http.StatusNotFound)
+			return
+		}
+		if enabled {
+			http.Error(w, "2fa already enabled", http.StatusConflict)
+			return
+		}
+		if !secret.Valid {
+			http.Error(w, "2fa enrollment not started", http.StatusBadRequest)
+			return
+		}
+		valid, err := useTOTP(r.Context(), db, userID, secret.String, req.Code)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if !valid {
+			http.Error(w, "invalid code", http.StatusForbidden)
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		if _, err := tx.ExecContext(r.Context(), "UPDATE users SET totp_enabled = 1 WHERE id = ?", userID); err != nil {
+			http.Error(w, "failed to enable 2fa", http.StatusInternalServerError)
+			return
+		}
+		codes, err := replaceRecoveryCodes(r.Context(), tx, userID)
+		if err != nil || tx.Commit() != nil {
+			http.Error(w, "failed to enable 2fa", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+	}
+}
+
+// LoginTOTPHandler - второй шаг входа: токен из LoginHandler и код из
+// приложения или один из кодов восстановления. Неверный код считается
+// неудачным входом и ведёт к блокировке так же, как неверный пароль.
+func LoginTOTPHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req LoginTOTPRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if ok, retryAfter := LoginIPLimiter.Allow(clientIP(r)); !ok {
+			tooManyRequests(w, "too many login attempts", retryAfter)
+			return
+		}
+		claims, err := parseMFAToken(req.MFAToken)
+		if err != nil {
+			http.Error(w, "invalid mfa token", http.StatusUnauthorized)
+			return
+		}
+		var user User
+		var secret sql.NullString
+		err = db.QueryRowContext(r.Context(),
+			"SELECT id, login, role, disabled, token_version, totp_enabled, totp_secret FROM users WHERE id = ?",
+			claims.UserID,
+		).Scan(&user.ID, &user.Login, &user.Role, &user.Disabled, &user.TokenVersion, &user.TOTPEnabled, &secret)
+		if err != nil || user.TokenVersion != claims.TokenVersion || !user.TOTPEnabled || !secret.Valid {
+			http.Error(w, "invalid mfa token", http.StatusUnauthorized)
+			return
+		}
+		if ok, retryAfter := LoginNameLimiter.Allow(user.Login); !ok {
+			tooManyRequests(w, "too many login attempts", retryAfter)
+			return
+		}
+		locked, err := lockedFor(db, user.Login)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if locked > 0 {
+			tooManyRequests(w, "too many failed login attempts", locked)
+			return
+		}
+
+		var valid bool
+		if req.RecoveryCode != "" {
+			valid, err = useRecoveryCode(r.Context(), db, user.ID, req.RecoveryCode)
+		} else {
+			valid, err = useTOTP(r.Context(), db, user.ID, secret.String, req.Code)
+		}
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if !valid {
+			if err := recordLoginFailure(db, user.Login); err != nil {
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			http.Error(w, "invalid code", http.StatusUnauthorized)
+			return
+		}
+		if err := resetLoginFailures(db, user.Login); err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if user.Disabled {
+			http.Error(w, "account disabled", http.StatusForbidden)
+			return
+		}
+		tokenString, err := issueToken(user)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"token": tokenString})
+	}
+}
+
+func ResetTOTPHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := pathUserID(r)
+		if err != nil {
+			http.Error(w, "invalid user id", http.StatusBadRequest)
+			return
+		}
+		writeUpdateResult(w, ResetTOTP(db, userID))
+	}
+}
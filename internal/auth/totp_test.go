@@ -0,0 +1,211 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode_RFC6238Vectors(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	for _, tc := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	} {
+		if got := totpCode(secret, tc.unix/totpPeriod); got != tc.code {
+			t.Fatalf("time %d: expected %s, got %s", tc.unix, tc.code, got)
+		}
+	}
+}
+
+func codeAt(t *testing.T, secret string, offset int64) string {
+	t.Helper()
+	key, err := base32NoPadding.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("invalid secret %q: %v", secret, err)
+	}
+	return totpCode(key, time.Now().Unix()/totpPeriod+offset)
+}
+
+// enableTOTP проходит подключение второго фактора и возвращает секрет и
+// коды восстановления.
+func enableTOTP(t *testing.T, db *sql.DB, token, password string) (string, []string) {
+	t.Helper()
+	w := callAccount(JWTMiddleware(db, EnrollTOTPHandler(db)), http.MethodPost, token, `{"password":"`+password+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("enroll failed: %d %s", w.Code, w.Body.String())
+	}
+	var enroll EnrollTOTPResponse
+	json.NewDecoder(w.Body).Decode(&enroll)
+	if !strings.HasPrefix(enroll.URI, "otpauth://totp/") || !strings.Contains(enroll.URI, "secret="+enroll.Secret) {
+		t.Fatalf("unexpected otpauth uri %q", enroll.URI)
+	}
+
+	confirm := JWTMiddleware(db, ConfirmTOTPHandler(db))
+	if w := callAccount(confirm, http.MethodPost, token, `{"code":"000000"}`); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for wrong confirmation code, got %d", w.Code)
+	}
+	w = callAccount(confirm, http.MethodPost, token, `{"code":"`+codeAt(t, enroll.Secret, 0)+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("confirm failed: %d %s", w.Code, w.Body.String())
+	}
+	var resp map[string][]string
+	json.NewDecoder(w.Body).Decode(&resp)
+	if len(resp["recovery_codes"]) != recoveryCodeCount {
+		t.Fatalf("expected %d recovery codes, got %v", recoveryCodeCount, resp["recovery_codes"])
+	}
+	return enroll.Secret, resp["recovery_codes"]
+}
+
+func loginMFAChallenge(t *testing.T, db *sql.DB, login, password string) string {
+	t.Helper()
+	w := postJSON(t, LoginHandler(db), "/api/v1/login", `{"login":"`+login+`","password":"`+password+`"}`)
+	var resp struct {
+		Token       string `json:"token"`
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if w.Code != http.StatusOK || !resp.MFARequired || resp.MFAToken == "" || resp.Token != "" {
+		t.Fatalf("expected mfa challenge, got %d %+v", w.Code, resp)
+	}
+	return resp.MFAToken
+}
+
+func loginSecondStep(t *testing.T, db *sql.DB, body string) (string, int) {
+	t.Helper()
+	w := postJSON(t, LoginTOTPHandler(db), "/api/v1/login/2fa", body)
+	var resp map[string]string
+	json.NewDecoder(w.Body).Decode(&resp)
+	return resp["token"], w.Code
+}
+
+func TestTOTPLogin(t *testing.T) {
+	db := setupSQLTestDB(t)
+	registerUser(t, db, "twofactor", "secret123")
+	token, _ := loginUser(t, db, "twofactor", "secret123")
+	secret, _ := enableTOTP(t, db, token, "secret123")
+
+	mfaToken := loginMFAChallenge(t, db, "twofactor", "secret123")
+	if code := callWithToken(JWTMiddleware(db, okHandler), mfaToken); code != http.StatusUnauthorized {
+		t.Fatalf("expected mfa token to be rejected as session, got %d", code)
+	}
+	if _, code := loginSecondStep(t, db, `{"mfa_token":"`+token+`","code":"`+codeAt(t, secret, 1)+`"}`); code != http.StatusUnauthorized {
+		t.Fatalf("expected session token to be rejected as mfa token, got %d", code)
+	}
+	if _, code := loginSecondStep(t, db, `{"mfa_token":"`+mfaToken+`","code":"000000"}`); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for wrong code, got %d", code)
+	}
+
+	// Код шага, использованного при подтверждении, повторно не принимается.
+	var lastStep int64
+	db.QueryRow("SELECT totp_last_step FROM users WHERE login = 'twofactor'").Scan(&lastStep)
+	key, _ := base32NoPadding.DecodeString(secret)
+	if _, code := loginSecondStep(t, db, `{"mfa_token":"`+mfaToken+`","code":"`+totpCode(key, lastStep)+`"}`); code != http.StatusUnauthorized {
+		t.Fatalf("expected replayed code to be rejected, got %d", code)
+	}
+	next := codeAt(t, secret, 1)
+	session, code := loginSecondStep(t, db, `{"mfa_token":"`+mfaToken+`","code":"`+next+`"}`)
+	if code != http.StatusOK {
+		t.Fatalf("expected second step to succeed, got %d", code)
+	}
+	if code := callWithToken(JWTMiddleware(db, okHandler), session); code != http.StatusOK {
+		t.Fatalf("expected session token to work, got %d", code)
+	}
+	if _, code := loginSecondStep(t, db, `{"mfa_token":"`+mfaToken+`","code":"`+next+`"}`); code != http.StatusUnauthorized {
+		t.Fatalf("expected replayed code to be rejected, got %d", code)
+	}
+}
+
+func TestTOTPLogin_RecoveryCodes(t *testing.T) {
+	db := setupSQLTestDB(t)
+	id := registerUser(t, db, "recovering", "secret123")
+	token, _ := loginUser(t, db, "recovering", "secret123")
+	_, codes := enableTOTP(t, db, token, "secret123")
+
+	var stored int
+	db.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND code_hash = ?", id, codes[0]).Scan(&stored)
+	if stored != 0 {
+		t.Fatal("expected recovery codes to be stored hashed")
+	}
+
+	mfaToken := loginMFAChallenge(t, db, "recovering", "secret123")
+	body := `{"mfa_token":"` + mfaToken + `","recovery_code":"` + strings.ToUpper(codes[0]) + `"}`
+	if _, code := loginSecondStep(t, db, body); code != http.StatusOK {
+		t.Fatalf("expected recovery code to work, got %d", code)
+	}
+	if _, code := loginSecondStep(t, db, body); code != http.StatusUnauthorized {
+		t.Fatalf("expected used recovery code to be rejected, got %d", code)
+	}
+}
+
+func TestTOTPLogin_FailuresLockOut(t *testing.T) {
+	db := setupSQLTestDB(t)
+	registerUser(t, db, "guessed", "secret123")
+	token, _ := loginUser(t, db, "guessed", "secret123")
+	secret, _ := enableTOTP(t, db, token, "secret123")
+
+	mfaToken := loginMFAChallenge(t, db, "guessed", "secret123")
+	for i := 0; i < Lockout.Threshold; i++ {
+		loginSecondStep(t, db, `{"mfa_token":"`+mfaToken+`","code":"000000"}`)
+	}
+	if _, code := loginSecondStep(t, db, `{"mfa_token":"`+mfaToken+`","code":"`+codeAt(t, secret, 1)+`"}`); code != http.StatusTooManyRequests {
+		t.Fatalf("expected lockout after repeated wrong codes, got %d", code)
+	}
+}
+
+func TestTOTPLogin_IPRateLimit(t *testing.T) {
+	db := setupSQLTestDB(t)
+	registerUser(t, db, "throttled", "secret123")
+	token, _ := loginUser(t, db, "throttled", "secret123")
+	enableTOTP(t, db, token, "secret123")
+	mfaToken := loginMFAChallenge(t, db, "throttled", "secret123")
+
+	defer func(ip, name *RateLimiter) { LoginIPLimiter, LoginNameLimiter = ip, name }(LoginIPLimiter, LoginNameLimiter)
+	LoginIPLimiter = NewRateLimiter(0.001, 1)
+	LoginNameLimiter = NewRateLimiter(1, 100)
+
+	if _, code := loginSecondStep(t, db, `{"mfa_token":"`+mfaToken+`","code":"000000"}`); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for wrong code, got %d", code)
+	}
+	if _, code := loginSecondStep(t, db, `{"mfa_token":"`+mfaToken+`","code":"000000"}`); code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 over per-IP limit, got %d", code)
+	}
+}
+
+func TestResetTOTP(t *testing.T) {
+	db := setupSQLTestDB(t)
+	id := registerUser(t, db, "lostphone", "secret123")
+	token, _ := loginUser(t, db, "lostphone", "secret123")
+	enableTOTP(t, db, token, "secret123")
+
+	if w := callAccount(JWTMiddleware(db, EnrollTOTPHandler(db)), http.MethodPost, token, `{"password":"secret123"}`); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 when 2fa is already enabled, got %d", w.Code)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("POST /api/v1/admin/users/{id}/2fa/reset", ResetTOTPHandler(db))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/admin/users/"+strconv.FormatInt(id, 10)+"/2fa/reset", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+	if _, code := loginUser(t, db, "lostphone", "secret123"); code != http.StatusOK {
+		t.Fatalf("expected password-only login after reset, got %d", code)
+	}
+	var codes int
+	db.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE user_id = ?", id).Scan(&codes)
+	if codes != 0 {
+		t.Fatalf("expected recovery codes to be removed, got %d", codes)
+	}
+}
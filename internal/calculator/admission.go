@@ -0,0 +1,151 @@
+package calculator
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	ReasonGlobalLimit = "global_limit_exceeded"
+	ReasonUserLimit   = "user_limit_exceeded"
+)
+
+// Limits ограничивает число выражений, которые вычисляются одновременно.
+// Нулевое значение лимита означает отсутствие ограничения.
+type Limits struct {
+	MaxInFlight        int
+	MaxInFlightPerUser int
+	RetryAfter         time.Duration
+}
+
+var DefaultLimits = Limits{
+	MaxInFlight:        10000,
+	MaxInFlightPerUser: 1000,
+	RetryAfter:         time.Second,
+}
+
+type Admission struct {
+	mu       sync.Mutex
+	limits   Limits
+	inFlight int
+	perUser  map[int64]int
+	rejected map[string]int64
+}
+
+type AdmissionStats struct {
+	InFlight           int              `json:"in_flight"`
+	MaxInFlight        int              `json:"max_in_flight"`
+	MaxInFlightPerUser int              `json:"max_in_flight_per_user"`
+	Rejected           map[string]int64 `json:"rejected"`
+}
+
+type RejectionResponse struct {
+	Error      string `json:"error"`
+	Reason     string `json:"reason"`
+	Limit      int    `json:"limit"`
+	RetryAfter int    `json:"retry_after_seconds"`
+}
+
+func NewAdmission(limits Limits) *Admission {
+	return &Admission{
+		limits:   limits,
+		perUser:  make(map[int64]int),
+		rejected: make(map[string]int64),
+	}
+}
+
+var admission = NewAdmission(DefaultLimits)
+
+func InitAdmission(a *Admission) {
+	admission = a
+}
+
+// Acquire резервирует n мест для пользователя. При успехе возвращает
+// функцию освобождения, иначе - причину отказа.
+func (a *Admission) Acquire(userID int64, n int) (func(), string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.limits.MaxInFlight > 0 && a.inFlight+n > a.limits.MaxInFlight {
+		a.rejected[ReasonGlobalLimit]++
+		return nil, ReasonGlobalLimit, false
+	}
+	if a.limits.MaxInFlightPerUser > 0 && a.perUser[userID]+n > a.limits.MaxInFlightPerUser {
+		a.rejected[ReasonUserLimit]++
+		return nil, ReasonUserLimit, false
+	}
+	a.inFlight += n
+	a.perUser[userID] += n
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { a.release(userID, n) })
+	}, "", true
+}
+
+func (a *Admission) release(userID int64, n int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.inFlight -= n
+	a.perUser[userID] -= n
+	if a.perUser[userID] <= 0 {
+		delete(a.perUser, userID)
+	}
+}
+
+func (a *Admission) Stats() AdmissionStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rejected := make(map[string]int64, len(a.rejected))
+	for reason, count := range a.rejected {
+		rejected[reason] = count
+	}
+	return AdmissionStats{
+		InFlight:           a.inFlight,
+		MaxInFlight:        a.limits.MaxInFlight,
+		MaxInFlightPerUser: a.limits.MaxInFlightPerUser,
+		Rejected:           rejected,
+	}
+}
+
+func (a *Admission) reject(w http.ResponseWriter, reason string) {
+	limit := a.limits.MaxInFlight
+	if reason == ReasonUserLimit {
+		limit = a.limits.MaxInFlightPerUser
+	}
+	retryAfter := int(a.limits.RetryAfter.Round(time.Second) / time.Second)
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(RejectionResponse{
+		Error:      "too many requests",
+		Reason:     reason,
+		Limit:      limit,
+		RetryAfter: retryAfter,
+	})
+}
+
+type Stats struct {
+	AdmissionStats
+	Memo *MemoStats `json:"memo,omitempty"`
+}
+
+func StatsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats := Stats{AdmissionStats: admission.Stats()}
+		if m := memo; m != nil {
+			memoStats := m.Stats()
+			stats.Memo = &memoStats
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	}
+}
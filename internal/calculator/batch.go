@@ -0,0 +1,161 @@
+package calculator
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"runtime"
+	"sync"
+
+	"distributed-calculator/internal/auth"
+)
+
+const maxBatchSize = 1000
+
+type BatchItem struct {
+	Expression string                 `json:"expression"`
+	Variables  map[string]interface{} `json:"variables,omitempty"`
+}
+
+type BatchCalculateRequest struct {
+	Expressions []BatchItem `json:"expressions"`
+	TimeoutMS   int         `json:"timeout_ms,omitempty"`
+}
+
+type BatchItemResult struct {
+	Index  int    `json:"index"`
+	Result string `json:"result,omitempty"`
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type BatchCalculateResponse struct {
+	Results []BatchItemResult `json:"results"`
+}
+
+func BatchCalculateHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req BatchCalculateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		userID, ok := auth.UserIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if len(req.Expressions) == 0 {
+			http.Error(w, "expressions required", http.StatusBadRequest)
+			return
+		}
+		if req.TimeoutMS < 0 {
+			http.Error(w, "invalid timeout_ms", http.StatusBadRequest)
+			return
+		}
+		if len(req.Expressions) > maxBatchSize {
+			http.Error(w, "too many expressions in batch", http.StatusBadRequest)
+			return
+		}
+
+		limiter := admission
+		release, reason, ok := limiter.Acquire(userID, len(req.Expressions))
+		if !ok {
+			limiter.reject(w, reason)
+			return
+		}
+		work := newEvaluations(release)
+		defer work.finish()
+
+		ctx, cancel := context.WithTimeout(work.track(r.Context()), evaluationTimeout(req.TimeoutMS))
+		results := evaluateBatch(ctx, req.Expressions)
+		cancel()
+		if r.Context().Err() != nil {
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			http.Error(w, "failed to save calculations", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		stmt, err := tx.PrepareContext(r.Context(),
+			"INSERT INTO calculations (user_id, expression, result, status, created_at) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)",
+		)
+		if err != nil {
+			http.Error(w, "failed to save calculations", http.StatusInternalServerError)
+			return
+		}
+		defer stmt.Close()
+		calculationIDs := make([]int64, len(results))
+		for i, res := range results {
+			if res.Status == "" {
+				continue
+			}
+			inserted, err := stmt.ExecContext(r.Context(), userID, req.Expressions[i].Expression, res.Result, res.Status)
+			if err != nil {
+				http.Error(w, "failed to save calculations", http.StatusInternalServerError)
+				return
+			}
+			calculationIDs[i], _ = inserted.LastInsertId()
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "failed to save calculations", http.StatusInternalServerError)
+			return
+		}
+		for i, res := range results {
+			if calculationIDs[i] != 0 && res.Status == StatusCompleted {
+				notifyWebhooks(userID, calculationIDs[i], req.Expressions[i].Expression, res.Result, nil)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(BatchCalculateResponse{Results: results})
+	}
+}
+
+func evaluateBatch(ctx context.Context, items []BatchItem) []BatchItemResult {
+	results := make([]BatchItemResult, len(items))
+	indexes := make(chan int)
+
+	workers := min(runtime.NumCPU(), len(items))
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for range workers {
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = evaluateBatchItem(ctx, i, items[i])
+			}
+		}()
+	}
+	for i := range items {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return results
+}
+
+func evaluateBatchItem(ctx context.Context, index int, item BatchItem) BatchItemResult {
+	result, err := evaluateMemoized(ctx, item.Expression, item.Variables)
+	switch {
+	case err == nil:
+		return BatchItemResult{Index: index, Result: result, Status: StatusCompleted}
+	case errors.Is(err, ErrInvalidExpression):
+		return BatchItemResult{Index: index, Error: "invalid expression"}
+	case errors.Is(err, ErrEvaluation):
+		return BatchItemResult{Index: index, Error: "evaluation error"}
+	case errors.Is(err, ErrNotStarted):
+		// Не начатое вычисление не сохраняется: его можно отправить ещё раз.
+		return BatchItemResult{Index: index, Error: "not evaluated: batch timed out"}
+	case errors.Is(err, context.DeadlineExceeded):
+		return BatchItemResult{Index: index, Status: StatusTimedOut, Error: "evaluation timed out"}
+	default:
+		return BatchItemResult{Index: index, Error: "cancelled"}
+	}
+}
@@ -1,18 +1,21 @@
 package calculator
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"net/http"
 
 	"distributed-calculator/internal/auth"
-
-	"github.com/Knetic/govaluate"
+	"distributed-calculator/internal/webhook"
 )
 
 type CalculateRequest struct {
-	Expression string `json:"expression"`
+	Expression     string `json:"expression"`
+	CallbackURL    string `json:"callback_url,omitempty"`
+	CallbackSecret string `json:"callback_secret,omitempty"`
+	TimeoutMS      int    `json:"timeout_ms,omitempty"`
 }
 
 type CalculateResponse struct {
@@ -31,27 +34,68 @@ func CalculateHandler(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
+		if req.TimeoutMS < 0 {
+			http.Error(w, "invalid timeout_ms", http.StatusBadRequest)
+			return
+		}
+		var callback *webhook.Target
+		if req.CallbackURL != "" {
+			if err := webhook.ValidateURL(req.CallbackURL); err != nil {
+				http.Error(w, "invalid callback_url", http.StatusBadRequest)
+				return
+			}
+			if req.CallbackSecret == "" {
+				http.Error(w, "callback_secret required with callback_url", http.StatusBadRequest)
+				return
+			}
+			callback = &webhook.Target{URL: req.CallbackURL, Secret: req.CallbackSecret}
+		}
 
-		expression, err := govaluate.NewEvaluableExpression(req.Expression)
-		if err != nil {
-			http.Error(w, "invalid expression", http.StatusBadRequest)
+		limiter := admission
+		release, reason, ok := limiter.Acquire(userID, 1)
+		if !ok {
+			limiter.reject(w, reason)
 			return
 		}
-		result, err := expression.Evaluate(nil)
+		work := newEvaluations(release)
+		defer work.finish()
+
+		ctx, cancel := context.WithTimeout(work.track(r.Context()), evaluationTimeout(req.TimeoutMS))
+		defer cancel()
+		resultStr, err := evaluateMemoized(ctx, req.Expression, nil)
 		if err != nil {
-			http.Error(w, "evaluation error", http.StatusBadRequest)
+			switch {
+			case errors.Is(err, ErrInvalidExpression):
+				http.Error(w, "invalid expression", http.StatusBadRequest)
+			case errors.Is(err, ErrEvaluation):
+				http.Error(w, "evaluation error", http.StatusBadRequest)
+			case errors.Is(err, ErrNotStarted) && r.Context().Err() == nil:
+				http.Error(w, "evaluation timed out", http.StatusGatewayTimeout)
+			case errors.Is(err, context.DeadlineExceeded) && r.Context().Err() == nil:
+				if err := saveTimedOut(r.Context(), db, userID, req.Expression); err != nil {
+					http.Error(w, "failed to save calculation", http.StatusInternalServerError)
+					return
+				}
+				http.Error(w, "evaluation timed out", http.StatusGatewayTimeout)
+			}
+			// Иначе клиент отключился: сохранять и отвечать некому.
 			return
 		}
-		resultStr := fmt.Sprintf("%v", result)
 
-		_, err = db.Exec(
-			"INSERT INTO calculations (user_id, expression, result, created_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP)",
-			userID, req.Expression, resultStr,
+		res, err := db.ExecContext(r.Context(),
+			"INSERT INTO calculations (user_id, expression, result, status, created_at) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)",
+			userID, req.Expression, resultStr, StatusCompleted,
 		)
 		if err != nil {
+			if r.Context().Err() != nil {
+				return
+			}
 			http.Error(w, "failed to save calculation", http.StatusInternalServerError)
 			return
 		}
+		if calculationID, err := res.LastInsertId(); err == nil {
+			notifyWebhooks(userID, calculationID, req.Expression, resultStr, callback)
+		}
 
 		json.NewEncoder(w).Encode(CalculateResponse{Result: resultStr})
 	}
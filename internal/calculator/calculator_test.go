@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"distributed-calculator/internal/auth"
 
@@ -31,6 +32,7 @@ func setupTestDB(t *testing.T) *sql.DB {
 		user_id INTEGER NOT NULL,
 		expression TEXT NOT NULL,
 		result TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'completed',
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 		FOREIGN KEY(user_id) REFERENCES users(id)
 	);
@@ -146,3 +148,343 @@ func TestCalculateHandler_InvalidJSON(t *testing.T) {
 		t.Fatalf("expected 400 for invalid json, got %d", w.Result().StatusCode)
 	}
 }
+
+func TestCalculateHandler_ClientDisconnected(t *testing.T) {
+	db := setupTestDB(t)
+
+	handler := CalculateHandler(db)
+
+	ctx, cancel := context.WithCancel(contextWithUserID(1))
+	cancel()
+
+	reqBody := `{"expression": "2+2"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", bytes.NewBufferString(reqBody))
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	handler(w, req)
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM calculations").Scan(&count); err != nil {
+		t.Fatalf("failed to query calculations: %v", err)
+	}
+	if count != 0 {
+		t.Fatalf("expected no calculations saved after disconnect, got %d", count)
+	}
+}
+
+func TestBatchCalculateHandler_PartialFailure(t *testing.T) {
+	db := setupTestDB(t)
+
+	handler := BatchCalculateHandler(db)
+
+	reqBody := `{"expressions": [
+		{"expression": "2+2"},
+		{"expression": "2++2"},
+		{"expression": "a*b", "variables": {"a": 3, "b": 5}}
+	]}`
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/calculate/batch", bytes.NewBufferString(reqBody))
+	req = req.WithContext(contextWithUserID(1))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	handler(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+
+	var batchResp BatchCalculateResponse
+	if err := json.NewDecoder(resp.Body).Decode(&batchResp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(batchResp.Results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(batchResp.Results))
+	}
+	if batchResp.Results[0].Result != "4" {
+		t.Fatalf("expected first result 4, got %+v", batchResp.Results[0])
+	}
+	if batchResp.Results[1].Error == "" {
+		t.Fatalf("expected error for invalid expression, got %+v", batchResp.Results[1])
+	}
+	if batchResp.Results[2].Result != "15" {
+		t.Fatalf("expected third result 15, got %+v", batchResp.Results[2])
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM calculations WHERE user_id = ?", 1).Scan(&count); err != nil {
+		t.Fatalf("failed to query calculations: %v", err)
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 calculations saved, got %d", count)
+	}
+}
+
+func TestBatchCalculateHandler_Empty(t *testing.T) {
+	db := setupTestDB(t)
+
+	handler := BatchCalculateHandler(db)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/calculate/batch", bytes.NewBufferString(`{"expressions": []}`))
+	req = req.WithContext(contextWithUserID(1))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	handler(w, req)
+
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for empty batch, got %d", w.Result().StatusCode)
+	}
+}
+
+func TestCalculateHandler_CallbackWithoutSecret(t *testing.T) {
+	db := setupTestDB(t)
+
+	handler := CalculateHandler(db)
+
+	reqBody := `{"expression": "2+2", "callback_url": "http://example.com/hook"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", bytes.NewBufferString(reqBody))
+	req = req.WithContext(contextWithUserID(1))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	handler(w, req)
+
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for callback without secret, got %d", w.Result().StatusCode)
+	}
+}
+
+func TestCalculateHandler_AdmissionLimit(t *testing.T) {
+	db := setupTestDB(t)
+
+	limiter := NewAdmission(Limits{MaxInFlightPerUser: 1, RetryAfter: 2 * time.Second})
+	InitAdmission(limiter)
+	defer InitAdmission(NewAdmission(DefaultLimits))
+
+	// Занимаем единственное место пользователя.
+	release, _, ok := limiter.Acquire(1, 1)
+	if !ok {
+		t.Fatal("expected first acquire to succeed")
+	}
+
+	handler := CalculateHandler(db)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", bytes.NewBufferString(`{"expression": "2+2"}`))
+	req = req.WithContext(contextWithUserID(1))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	handler(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 over limit, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") != "2" {
+		t.Fatalf("expected Retry-After 2, got %q", resp.Header.Get("Retry-After"))
+	}
+	var rejection RejectionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rejection); err != nil {
+		t.Fatalf("failed to decode rejection: %v", err)
+	}
+	if rejection.Reason != ReasonUserLimit {
+		t.Fatalf("expected reason %s, got %s", ReasonUserLimit, rejection.Reason)
+	}
+
+	// Другой пользователь не упирается в чужой лимит.
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/calculate", bytes.NewBufferString(`{"expression": "2+2"}`))
+	req = req.WithContext(contextWithUserID(2))
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for another user, got %d", w.Result().StatusCode)
+	}
+
+	release()
+	stats := limiter.Stats()
+	if stats.InFlight != 0 || stats.Rejected[ReasonUserLimit] != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestCalculateHandler_TimedOut(t *testing.T) {
+	db := setupTestDB(t)
+
+	// Вычисление, которое не успевает до дедлайна.
+	evaluate = func(ctx context.Context, expression string, parameters map[string]interface{}) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	defer func() { evaluate = Evaluate }()
+
+	handler := CalculateHandler(db)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", bytes.NewBufferString(`{"expression": "2+2", "timeout_ms": 5}`))
+	req = req.WithContext(contextWithUserID(1))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	handler(w, req)
+
+	if w.Result().StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504 on timeout, got %d", w.Result().StatusCode)
+	}
+
+	var status string
+	if err := db.QueryRow("SELECT status FROM calculations WHERE user_id = ?", 1).Scan(&status); err != nil {
+		t.Fatalf("failed to query calculation: %v", err)
+	}
+	if status != StatusTimedOut {
+		t.Fatalf("expected status %s, got %s", StatusTimedOut, status)
+	}
+}
+
+func TestEvaluationTimeout(t *testing.T) {
+	if got := evaluationTimeout(0); got != MaxEvaluationTimeout {
+		t.Fatalf("expected server maximum without timeout_ms, got %v", got)
+	}
+	if got := evaluationTimeout(250); got != 250*time.Millisecond {
+		t.Fatalf("expected 250ms, got %v", got)
+	}
+	if got := evaluationTimeout(int(MaxEvaluationTimeout/time.Millisecond) * 2); got != MaxEvaluationTimeout {
+		t.Fatalf("expected timeout_ms to be capped at server maximum, got %v", got)
+	}
+}
+
+func TestBatchCalculateHandler_Memo(t *testing.T) {
+	db := setupTestDB(t)
+
+	InitMemo(NewMemo(10))
+	defer InitMemo(nil)
+
+	handler := BatchCalculateHandler(db)
+
+	reqBody := `{"expressions": [
+		{"expression": "(a*b+1)*2", "variables": {"a": 3, "b": 5}},
+		{"expression": "( a * b + 1 ) * 2.0", "variables": {"b": 5, "a": 3}}
+	]}`
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/calculate/batch", bytes.NewBufferString(reqBody))
+		req = req.WithContext(contextWithUserID(1))
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Result().StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Result().StatusCode)
+		}
+	}
+
+	// Четыре одинаковых по смыслу выражения: один промах и три попадания,
+	// если два первых не вычислялись одновременно.
+	stats := memo.Stats()
+	if stats.Size != 1 || stats.Hits+stats.Misses != 4 || stats.Hits < 2 {
+		t.Fatalf("unexpected memo stats %+v", stats)
+	}
+}
+
+func TestMemo_Eviction(t *testing.T) {
+	m := NewMemo(2)
+	m.put("a", "1")
+	m.put("b", "2")
+	m.get("a")
+	m.put("c", "3")
+
+	if _, ok := m.get("b"); ok {
+		t.Fatal("expected least recently used entry to be evicted")
+	}
+	if result, ok := m.get("a"); !ok || result != "1" {
+		t.Fatalf("expected recently used entry to stay, got %q %v", result, ok)
+	}
+}
+
+func TestCalculateHandler_TimedOutSaveFails(t *testing.T) {
+	db := setupTestDB(t)
+	evaluate = func(ctx context.Context, expression string, parameters map[string]interface{}) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	defer func() { evaluate = Evaluate }()
+	if _, err := db.Exec("DROP TABLE calculations"); err != nil {
+		t.Fatalf("failed to drop table: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", bytes.NewBufferString(`{"expression": "2+2", "timeout_ms": 5}`))
+	req = req.WithContext(contextWithUserID(1))
+	w := httptest.NewRecorder()
+	CalculateHandler(db)(w, req)
+
+	if w.Result().StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected 500 when timed out row can't be saved, got %d", w.Result().StatusCode)
+	}
+}
+
+func TestCalculateHandler_TimedOutHoldsAdmissionSlot(t *testing.T) {
+	db := setupTestDB(t)
+	limiter := NewAdmission(DefaultLimits)
+	InitAdmission(limiter)
+	defer InitAdmission(NewAdmission(DefaultLimits))
+
+	// Вычисление, которое продолжается после дедлайна, как govaluate.
+	unblock := make(chan struct{})
+	evaluate = func(ctx context.Context, expression string, parameters map[string]interface{}) (string, error) {
+		_, err := runDetached(ctx, func() (interface{}, error) {
+			<-unblock
+			return "4", nil
+		})
+		return "", err
+	}
+	defer func() { evaluate = Evaluate }()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", bytes.NewBufferString(`{"expression": "2+2", "timeout_ms": 5}`))
+	req = req.WithContext(contextWithUserID(1))
+	w := httptest.NewRecorder()
+	CalculateHandler(db)(w, req)
+	if w.Result().StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d", w.Result().StatusCode)
+	}
+	if inFlight := limiter.Stats().InFlight; inFlight != 1 {
+		t.Fatalf("expected slot to stay taken while evaluation runs, got %d in flight", inFlight)
+	}
+
+	close(unblock)
+	deadline := time.Now().Add(time.Second)
+	for limiter.Stats().InFlight != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected slot to be released after evaluation finished")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestEvaluateBatchItem_AfterDeadline(t *testing.T) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	// Неверное выражение остаётся неверным и после дедлайна.
+	if res := evaluateBatchItem(ctx, 0, BatchItem{Expression: "2++"}); res.Status != "" || res.Error != "invalid expression" {
+		t.Fatalf("expected invalid expression, got %+v", res)
+	}
+	// Не начатое вычисление не сохраняется как timed_out.
+	if res := evaluateBatchItem(ctx, 1, BatchItem{Expression: "2+2"}); res.Status != "" || res.Error == "" {
+		t.Fatalf("expected unsaved error for item not started, got %+v", res)
+	}
+}
+
+func TestMemo_StringLiteralDoesNotCollide(t *testing.T) {
+	InitMemo(NewMemo(10))
+	defer InitMemo(nil)
+
+	// Раньше литерал давал тот же ключ, что и 'a' + 'b', и подменял чужой результат.
+	if _, err := evaluateMemoized(context.Background(), `'a 12:+ 4:b'`, nil); err != nil {
+		t.Fatalf("failed to evaluate literal: %v", err)
+	}
+	result, err := evaluateMemoized(context.Background(), `'a' + 'b'`, nil)
+	if err != nil || result != "ab" {
+		t.Fatalf("expected ab, got %q (%v)", result, err)
+	}
+	if memo.Stats().Size != 2 {
+		t.Fatalf("expected two distinct memo entries, got %+v", memo.Stats())
+	}
+}
@@ -0,0 +1,73 @@
+package calculator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Knetic/govaluate"
+)
+
+var (
+	ErrInvalidExpression = errors.New("invalid expression")
+	ErrEvaluation        = errors.New("evaluation error")
+	// ErrNotStarted - дедлайн истёк раньше, чем вычисление началось.
+	ErrNotStarted = errors.New("evaluation not started")
+)
+
+// Evaluate вычисляет выражение и прекращает ожидание, как только ctx отменён.
+func Evaluate(ctx context.Context, expression string, parameters map[string]interface{}) (string, error) {
+	// Разбор быстрый, поэтому неверное выражение отклоняется даже после дедлайна.
+	expr, err := govaluate.NewEvaluableExpression(expression)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidExpression, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrNotStarted, err)
+	}
+
+	value, err := runDetached(ctx, func() (interface{}, error) {
+		return expr.Evaluate(parameters)
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%v", value), nil
+}
+
+// runDetached выполняет fn в отдельной горутине и при отмене ctx возвращается,
+// не дожидаясь её: govaluate нельзя прервать. Горутина учитывается в
+// evaluations из контекста до своего настоящего завершения.
+func runDetached(ctx context.Context, fn func() (interface{}, error)) (interface{}, error) {
+	type outcome struct {
+		value interface{}
+		err   error
+	}
+	done := make(chan outcome, 1)
+	tracker, _ := ctx.Value(evaluationsKey{}).(*evaluations)
+	if tracker != nil {
+		tracker.start()
+	}
+	go func() {
+		if tracker != nil {
+			defer tracker.stop()
+		}
+		defer func() {
+			if p := recover(); p != nil {
+				done <- outcome{err: fmt.Errorf("panic: %v", p)}
+			}
+		}()
+		value, err := fn()
+		done <- outcome{value: value, err: err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case out := <-done:
+		if out.err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrEvaluation, out.err)
+		}
+		return out.value, nil
+	}
+}
@@ -0,0 +1,69 @@
+package calculator
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"distributed-calculator/internal/auth"
+	"distributed-calculator/internal/models"
+)
+
+const maxCalculationsListed = 100
+
+func listCalculations(ctx context.Context, db *sql.DB, userID int64) ([]models.Calculation, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT id, user_id, expression, result, status, created_at
+		FROM calculations WHERE user_id = ? ORDER BY id DESC LIMIT ?`,
+		userID, maxCalculationsListed,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	calculations := []models.Calculation{}
+	for rows.Next() {
+		var c models.Calculation
+		if err := rows.Scan(&c.ID, &c.UserID, &c.Expression, &c.Result, &c.Status, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		calculations = append(calculations, c)
+	}
+	return calculations, rows.Err()
+}
+
+func writeCalculations(w http.ResponseWriter, r *http.Request, db *sql.DB, userID int64) {
+	calculations, err := listCalculations(r.Context(), db, userID)
+	if err != nil {
+		http.Error(w, "failed to load calculations", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(calculations)
+}
+
+// HistoryHandler возвращает последние вычисления текущего пользователя.
+func HistoryHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.UserIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		writeCalculations(w, r, db, userID)
+	}
+}
+
+// UserCalculationsHandler возвращает вычисления пользователя из пути; только для администраторов.
+func UserCalculationsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid user id", http.StatusBadRequest)
+			return
+		}
+		writeCalculations(w, r, db, userID)
+	}
+}
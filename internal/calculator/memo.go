@@ -0,0 +1,132 @@
+package calculator
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/Knetic/govaluate"
+)
+
+// Memo - общий для всех пользователей LRU-кэш результатов, ключом служит
+// каноническая запись выражения вместе со значениями переменных.
+type Memo struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+	hits     int64
+	misses   int64
+}
+
+type MemoStats struct {
+	Size     int   `json:"size"`
+	Capacity int   `json:"capacity"`
+	Hits     int64 `json:"hits"`
+	Misses   int64 `json:"misses"`
+}
+
+type memoEntry struct {
+	key    string
+	result string
+}
+
+func NewMemo(capacity int) *Memo {
+	return &Memo{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// memo выключен, пока не задан через InitMemo.
+var memo *Memo
+
+func InitMemo(m *Memo) {
+	memo = m
+}
+
+func (m *Memo) get(key string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.entries[key]
+	if !ok {
+		m.misses++
+		return "", false
+	}
+	m.hits++
+	m.order.MoveToFront(el)
+	return el.Value.(*memoEntry).result, true
+}
+
+func (m *Memo) put(key, result string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.entries[key]; ok {
+		m.order.MoveToFront(el)
+		return
+	}
+	m.entries[key] = m.order.PushFront(&memoEntry{key: key, result: result})
+	if m.order.Len() > m.capacity {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.entries, oldest.Value.(*memoEntry).key)
+	}
+}
+
+func (m *Memo) Stats() MemoStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return MemoStats{Size: m.order.Len(), Capacity: m.capacity, Hits: m.hits, Misses: m.misses}
+}
+
+// memoToken - лексема выражения в ключе кэша. Ключ собирается через JSON,
+// чтобы строковый литерал не мог изобразить последовательность лексем.
+type memoToken struct {
+	Kind  govaluate.TokenKind `json:"k"`
+	Value interface{}         `json:"v"`
+}
+
+// canonicalKey не зависит от пробелов и записи чисел: "2+2" и "2 + 2.0" совпадают.
+func canonicalKey(expression string, parameters map[string]interface{}) (string, error) {
+	expr, err := govaluate.NewEvaluableExpression(expression)
+	if err != nil {
+		return "", err
+	}
+	tokens := expr.Tokens()
+	parts := make([]memoToken, len(tokens))
+	for i, token := range tokens {
+		parts[i] = memoToken{Kind: token.Kind, Value: token.Value}
+	}
+	key, err := json.Marshal(struct {
+		Tokens     []memoToken            `json:"tokens"`
+		Parameters map[string]interface{} `json:"parameters"`
+	}{parts, parameters})
+	if err != nil {
+		return "", err
+	}
+	return string(key), nil
+}
+
+func evaluateMemoized(ctx context.Context, expression string, parameters map[string]interface{}) (string, error) {
+	m := memo
+	if m == nil {
+		return evaluate(ctx, expression, parameters)
+	}
+	key, err := canonicalKey(expression, parameters)
+	if err != nil {
+		return evaluate(ctx, expression, parameters)
+	}
+	if result, ok := m.get(key); ok {
+		return result, nil
+	}
+	result, err := evaluate(ctx, expression, parameters)
+	if err == nil {
+		m.put(key, result)
+	}
+	return result, err
+}
@@ -0,0 +1,84 @@
+package calculator
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+const (
+	StatusCompleted = "completed"
+	StatusTimedOut  = "timed_out"
+)
+
+// MaxEvaluationTimeout ограничивает время вычисления на сервере;
+// timeout_ms из запроса может его только сократить.
+var MaxEvaluationTimeout = 10 * time.Second
+
+var evaluate = Evaluate
+
+type evaluationsKey struct{}
+
+// evaluations считает горутины вычислений одного запроса. govaluate нельзя
+// прервать, и после таймаута вычисление продолжается в фоне, поэтому место
+// в лимите admission освобождается, только когда запрос завершён и все его
+// горутины закончили работу.
+type evaluations struct {
+	mu       sync.Mutex
+	running  int
+	finished bool
+	release  func()
+}
+
+func newEvaluations(release func()) *evaluations {
+	return &evaluations{release: release}
+}
+
+// track возвращает контекст, в котором Evaluate отмечает свои горутины.
+func (e *evaluations) track(ctx context.Context) context.Context {
+	return context.WithValue(ctx, evaluationsKey{}, e)
+}
+
+func (e *evaluations) start() {
+	e.mu.Lock()
+	e.running++
+	e.mu.Unlock()
+}
+
+func (e *evaluations) stop() {
+	e.mu.Lock()
+	e.running--
+	done := e.finished && e.running == 0
+	e.mu.Unlock()
+	if done {
+		e.release()
+	}
+}
+
+// finish вызывается по окончании запроса.
+func (e *evaluations) finish() {
+	e.mu.Lock()
+	e.finished = true
+	done := e.running == 0
+	e.mu.Unlock()
+	if done {
+		e.release()
+	}
+}
+
+func evaluationTimeout(timeoutMS int) time.Duration {
+	timeout := MaxEvaluationTimeout
+	if requested := time.Duration(timeoutMS) * time.Millisecond; requested > 0 && requested < timeout {
+		timeout = requested
+	}
+	return timeout
+}
+
+func saveTimedOut(ctx context.Context, db *sql.DB, userID int64, expression string) error {
+	_, err := db.ExecContext(ctx,
+		"INSERT INTO calculations (user_id, expression, result, status, created_at) VALUES (?, ?, '', ?, CURRENT_TIMESTAMP)",
+		userID, expression, StatusTimedOut,
+	)
+	return err
+}
@@ -0,0 +1,23 @@
+package calculator
+
+import (
+	"log"
+
+	"distributed-calculator/internal/webhook"
+)
+
+var webhooks *webhook.Dispatcher
+
+func InitWebhooks(d *webhook.Dispatcher) {
+	webhooks = d
+}
+
+func notifyWebhooks(userID, calculationID int64, expression, result string, callback *webhook.Target) {
+	if webhooks == nil {
+		return
+	}
+	payload := webhook.Payload{CalculationID: calculationID, Expression: expression, Result: result}
+	if err := webhooks.Notify(userID, payload, callback); err != nil {
+		log.Printf("webhook notify for calculation %d: %v", calculationID, err)
+	}
+}
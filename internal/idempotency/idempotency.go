@@ -0,0 +1,202 @@
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"distributed-calculator/internal/auth"
+)
+
+const (
+	KeyHeader      = "Idempotency-Key"
+	ReplayedHeader = "Idempotent-Replayed"
+)
+
+const (
+	maxKeyLength = 255
+	maxBodySize  = 1 << 20
+)
+
+// Retention - сколько хранится сохранённый ответ для ключа.
+var Retention = 24 * time.Hour
+
+// Просроченные ключи всех пользователей удаляются не чаще раза в sweepInterval.
+const sweepInterval = time.Minute
+
+var (
+	sweepMu   sync.Mutex
+	lastSweep time.Time
+)
+
+func retentionModifier() string {
+	return fmt.Sprintf("-%d seconds", int(Retention.Seconds()))
+}
+
+func sweepExpired(ctx context.Context, db *sql.DB) {
+	sweepMu.Lock()
+	if time.Since(lastSweep) < sweepInterval {
+		sweepMu.Unlock()
+		return
+	}
+	lastSweep = time.Now()
+	sweepMu.Unlock()
+
+	if _, err := db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE created_at < datetime('now', ?)", retentionModifier()); err != nil {
+		log.Printf("idempotency: failed to delete expired keys: %v", err)
+	}
+}
+
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *recorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// Middleware повторяет сохранённый ответ, если пользователь присылает тот же
+// Idempotency-Key с тем же телом запроса. Должен стоять после JWTMiddleware.
+func Middleware(db *sql.DB, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(KeyHeader)
+		userID, ok := auth.UserIDFromContext(r.Context())
+		if key == "" || !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxKeyLength {
+			http.Error(w, "idempotency key too long", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+		if err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if len(body) > maxBodySize {
+			http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := fingerprintOf(r, body)
+
+		sweepExpired(r.Context(), db)
+		_, err = db.ExecContext(r.Context(),
+			"DELETE FROM idempotency_keys WHERE user_id = ? AND key = ? AND created_at < datetime('now', ?)",
+			userID, key, retentionModifier(),
+		)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		res, err := db.ExecContext(r.Context(),
+			"INSERT INTO idempotency_keys (user_id, key, fingerprint, created_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP) ON CONFLICT DO NOTHING",
+			userID, key, fingerprint,
+		)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			replay(w, r, db, userID, key, fingerprint)
+			return
+		}
+
+		// Если обработчик паникует, ключ освобождается, иначе повтор
+		// получал бы 409 до истечения Retention.
+		defer func() {
+			if p := recover(); p != nil {
+				releaseKey(db, userID, key)
+				panic(p)
+			}
+		}()
+		rec := &recorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		// Ошибки сервера, отказы по лимиту и оборванные запросы не запоминаем,
+		// чтобы клиент мог повторить.
+		if rec.status == 0 || rec.status == http.StatusTooManyRequests || rec.status >= http.StatusInternalServerError {
+			releaseKey(db, userID, key)
+			return
+		}
+		_, err = db.Exec(
+			"UPDATE idempotency_keys SET status_code = ?, content_type = ?, response_body = ? WHERE user_id = ? AND key = ?",
+			rec.status, w.Header().Get("Content-Type"), rec.body.Bytes(), userID, key,
+		)
+		if err != nil {
+			// Без сохранённого ответа ключ отвечал бы 409 до истечения Retention,
+			// поэтому он освобождается и клиент может повторить.
+			log.Printf("idempotency: failed to store response: %v", err)
+			releaseKey(db, userID, key)
+		}
+	})
+}
+
+func releaseKey(db *sql.DB, userID int64, key string) {
+	if _, err := db.Exec("DELETE FROM idempotency_keys WHERE user_id = ? AND key = ?", userID, key); err != nil {
+		log.Printf("idempotency: failed to release key: %v", err)
+	}
+}
+
+func replay(w http.ResponseWriter, r *http.Request, db *sql.DB, userID int64, key, fingerprint string) {
+	var storedFingerprint string
+	var status sql.NullInt64
+	var contentType sql.NullString
+	var body []byte
+	err := db.QueryRowContext(r.Context(),
+		"SELECT fingerprint, status_code, content_type, response_body FROM idempotency_keys WHERE user_id = ? AND key = ?",
+		userID, key,
+	).Scan(&storedFingerprint, &status, &contentType, &body)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "request with this idempotency key is in progress", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if storedFingerprint != fingerprint {
+		http.Error(w, "idempotency key reused with a different request", http.StatusUnprocessableEntity)
+		return
+	}
+	if !status.Valid {
+		http.Error(w, "request with this idempotency key is in progress", http.StatusConflict)
+		return
+	}
+	if contentType.String != "" {
+		w.Header().Set("Content-Type", contentType.String)
+	}
+	w.Header().Set(ReplayedHeader, "true")
+	w.WriteHeader(int(status.Int64))
+	w.Write(body)
+}
+
+func fingerprintOf(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
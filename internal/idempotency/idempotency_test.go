@@ -0,0 +1,188 @@
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"distributed-calculator/internal/auth"
+	"distributed-calculator/internal/storage"
+)
+
+func setupTestDB(t *testing.T) *sql.DB {
+	db, err := storage.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("failed to open test db: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	// Ключи ссылаются на пользователей внешним ключом.
+	if _, err := db.Exec("INSERT INTO users (login, password_hash) VALUES ('first', 'x'), ('second', 'x')"); err != nil {
+		t.Fatalf("failed to create users: %v", err)
+	}
+	return db
+}
+
+func newRequest(userID int64, key, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", bytes.NewBufferString(body))
+	req = req.WithContext(context.WithValue(req.Context(), auth.UserIDKey, userID))
+	if key != "" {
+		req.Header.Set(KeyHeader, key)
+	}
+	return req
+}
+
+func TestMiddleware_Replay(t *testing.T) {
+	db := setupTestDB(t)
+
+	calls := 0
+	handler := Middleware(db, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"result":"4"}`))
+	}))
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newRequest(1, "key-1", `{"expression":"2+2"}`))
+		if w.Code != http.StatusOK || w.Body.String() != `{"result":"4"}` {
+			t.Fatalf("attempt %d: unexpected response %d %s", i, w.Code, w.Body.String())
+		}
+		if i == 1 && w.Header().Get(ReplayedHeader) != "true" {
+			t.Fatal("expected replayed response on retry")
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected handler to run once, ran %d times", calls)
+	}
+
+	// Тот же ключ у другого пользователя - независимый запрос.
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newRequest(2, "key-1", `{"expression":"2+2"}`))
+	if calls != 2 {
+		t.Fatalf("expected handler to run for another user, ran %d times", calls)
+	}
+}
+
+func TestMiddleware_KeyReusedWithDifferentBody(t *testing.T) {
+	db := setupTestDB(t)
+
+	handler := Middleware(db, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"result":"4"}`))
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newRequest(1, "key-1", `{"expression":"2+2"}`))
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newRequest(1, "key-1", `{"expression":"3+3"}`))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for reused key, got %d", w.Code)
+	}
+}
+
+func TestMiddleware_ServerErrorNotStored(t *testing.T) {
+	db := setupTestDB(t)
+
+	calls := 0
+	handler := Middleware(db, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, "failed to save calculation", http.StatusInternalServerError)
+	}))
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newRequest(1, "key-1", `{"expression":"2+2"}`))
+	}
+	if calls != 2 {
+		t.Fatalf("expected server errors to be retried, handler ran %d times", calls)
+	}
+}
+
+func TestMiddleware_SweepsExpiredKeys(t *testing.T) {
+	db := setupTestDB(t)
+	_, err := db.Exec(`INSERT INTO idempotency_keys (user_id, key, fingerprint, status_code, created_at)
+		VALUES (2, 'old', 'f', 200, datetime('now', '-2 days')), (2, 'fresh', 'f', 200, CURRENT_TIMESTAMP)`)
+	if err != nil {
+		t.Fatalf("failed to insert keys: %v", err)
+	}
+	sweepMu.Lock()
+	lastSweep = time.Time{}
+	sweepMu.Unlock()
+
+	handler := Middleware(db, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest(1, "key-1", `{"expression":"2+2"}`))
+
+	var keys []string
+	rows, err := db.Query("SELECT key FROM idempotency_keys WHERE user_id = 2")
+	if err != nil {
+		t.Fatalf("failed to query keys: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		rows.Scan(&key)
+		keys = append(keys, key)
+	}
+	if len(keys) != 1 || keys[0] != "fresh" {
+		t.Fatalf("expected only unexpired keys of other users to remain, got %v", keys)
+	}
+}
+
+func TestMiddleware_PanicReleasesKey(t *testing.T) {
+	db := setupTestDB(t)
+
+	calls := 0
+	handler := Middleware(db, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			panic("boom")
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	func() {
+		defer func() {
+			if p := recover(); p != "boom" {
+				t.Fatalf("expected panic to propagate, got %v", p)
+			}
+		}()
+		handler.ServeHTTP(httptest.NewRecorder(), newRequest(1, "key-1", `{"expression":"2+2"}`))
+	}()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newRequest(1, "key-1", `{"expression":"2+2"}`))
+	if w.Code != http.StatusOK || calls != 2 {
+		t.Fatalf("expected retry after panic to run the handler, got %d after %d calls", w.Code, calls)
+	}
+}
+
+func TestMiddleware_FailedStoreReleasesKey(t *testing.T) {
+	db := setupTestDB(t)
+	_, err := db.Exec(`CREATE TRIGGER fail_store BEFORE UPDATE ON idempotency_keys
+		BEGIN SELECT RAISE(ABORT, 'disk full'); END`)
+	if err != nil {
+		t.Fatalf("failed to create trigger: %v", err)
+	}
+
+	calls := 0
+	handler := Middleware(db, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusOK)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest(1, "key-1", `{"expression":"2+2"}`))
+
+	// Ответ не сохранился, поэтому повтор не должен получать 409 до истечения Retention.
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newRequest(1, "key-1", `{"expression":"2+2"}`))
+	if w.Code != http.StatusOK || calls != 2 {
+		t.Fatalf("expected retry after failed store to run the handler, got %d after %d calls", w.Code, calls)
+	}
+}
@@ -5,12 +5,16 @@ type User struct {
 	ID           int64  
 	Login        string
 	PasswordHash string
+	Role         string
+	Disabled     bool
+	TokenVersion int64
 }
 
 type Calculation struct {
-	ID         int64 
-	UserID     int64
-	Expression string
-	Result     string
-	CreatedAt  string
+	ID         int64  `json:"id"`
+	UserID     int64  `json:"user_id"`
+	Expression string `json:"expression"`
+	Result     string `json:"result"`
+	Status     string `json:"status"`
+	CreatedAt  string `json:"created_at"`
 }
@@ -2,12 +2,23 @@ package storage
 
 import (
 	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// userTables - таблицы со строками пользователя, удаляемые вместе с ним.
+var userTables = []string{"calculations", "webhook_endpoints", "webhook_deliveries", "idempotency_keys", "api_keys", "user_identities", "recovery_codes"}
+
 func NewSQLite(filepath string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", filepath)
+	// Без _foreign_keys SQLite не проверяет внешние ключи и не выполняет ON DELETE CASCADE.
+	sep := "?"
+	if strings.Contains(filepath, "?") {
+		sep = "&"
+	}
+	db, err := sql.Open("sqlite3", filepath+sep+"_foreign_keys=1")
 	if err != nil {
 		return nil, err
 	}
@@ -22,16 +33,181 @@ func migrate(db *sql.DB) error {
         CREATE TABLE IF NOT EXISTS users (
             id INTEGER PRIMARY KEY AUTOINCREMENT,
             login TEXT UNIQUE NOT NULL,
-            password_hash TEXT NOT NULL
+            password_hash TEXT NOT NULL,
+            role TEXT NOT NULL DEFAULT 'user',
+            disabled INTEGER NOT NULL DEFAULT 0,
+            token_version INTEGER NOT NULL DEFAULT 0,
+            totp_secret TEXT,
+            totp_enabled INTEGER NOT NULL DEFAULT 0,
+            totp_last_step INTEGER
         );
         CREATE TABLE IF NOT EXISTS calculations (
             id INTEGER PRIMARY KEY AUTOINCREMENT,
             user_id INTEGER NOT NULL,
             expression TEXT NOT NULL,
             result TEXT NOT NULL,
+            status TEXT NOT NULL DEFAULT 'completed',
+            created_at DATETIME NOT NULL,
+            FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+        );
+        CREATE TABLE IF NOT EXISTS webhook_endpoints (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            user_id INTEGER NOT NULL,
+            url TEXT NOT NULL,
+            secret TEXT NOT NULL,
+            created_at DATETIME NOT NULL,
+            FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+        );
+        CREATE TABLE IF NOT EXISTS webhook_deliveries (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            user_id INTEGER NOT NULL,
+            calculation_id INTEGER NOT NULL,
+            url TEXT NOT NULL,
+            status TEXT NOT NULL,
+            attempts INTEGER NOT NULL DEFAULT 0,
+            response_code INTEGER,
+            last_error TEXT,
+            created_at DATETIME NOT NULL,
+            updated_at DATETIME NOT NULL,
+            FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+        );
+        CREATE TABLE IF NOT EXISTS idempotency_keys (
+            user_id INTEGER NOT NULL,
+            key TEXT NOT NULL,
+            fingerprint TEXT NOT NULL,
+            status_code INTEGER,
+            content_type TEXT,
+            response_body BLOB,
+            created_at DATETIME NOT NULL,
+            PRIMARY KEY(user_id, key),
+            FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+        );
+        CREATE TABLE IF NOT EXISTS api_keys (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            user_id INTEGER NOT NULL,
+            name TEXT NOT NULL,
+            prefix TEXT UNIQUE NOT NULL,
+            key_hash TEXT NOT NULL,
+            scopes TEXT NOT NULL,
+            expires_at INTEGER,
+            last_used_at DATETIME,
+            revoked_at DATETIME,
+            created_at DATETIME NOT NULL,
+            FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+        );
+        CREATE TABLE IF NOT EXISTS user_identities (
+            issuer TEXT NOT NULL,
+            subject TEXT NOT NULL,
+            user_id INTEGER NOT NULL,
+            created_at DATETIME NOT NULL,
+            PRIMARY KEY(issuer, subject),
+            FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+        );
+        CREATE TABLE IF NOT EXISTS recovery_codes (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            user_id INTEGER NOT NULL,
+            code_hash TEXT NOT NULL,
+            used_at DATETIME,
             created_at DATETIME NOT NULL,
-            FOREIGN KEY(user_id) REFERENCES users(id)
+            FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+        );
+        CREATE TABLE IF NOT EXISTS login_failures (
+            login TEXT PRIMARY KEY,
+            failures INTEGER NOT NULL,
+            locked_until INTEGER,
+            updated_at DATETIME NOT NULL
         );
     `)
+	if err != nil {
+		return err
+	}
+	columns := []struct{ table, column, definition string }{
+		{"calculations", "status", "TEXT NOT NULL DEFAULT 'completed'"},
+		{"users", "role", "TEXT NOT NULL DEFAULT 'user'"},
+		{"users", "disabled", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "token_version", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "totp_secret", "TEXT"},
+		{"users", "totp_enabled", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "totp_last_step", "INTEGER"},
+	}
+	for _, c := range columns {
+		if err := addColumn(db, c.table, c.column, c.definition); err != nil {
+			return err
+		}
+	}
+	for _, table := range userTables {
+		if err := cascadeUserDelete(db, table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumn добавляет колонку в таблицу, созданную до её появления в схеме.
+func addColumn(db *sql.DB, table, column, definition string) error {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
 	return err
 }
+
+// identQuote - необязательные кавычки вокруг имени в SQL.
+const identQuote = "[\"'`\\[\\]]?"
+
+// usersReference находит ссылку на users(id) в любом допустимом написании.
+var usersReference = regexp.MustCompile(`(?i)REFERENCES\s+` + identQuote + `users` + identQuote + `\s*\(\s*` + identQuote + `id` + identQuote + `\s*\)`)
+
+// cascadeUserDelete пересоздаёт таблицу, созданную без ON DELETE CASCADE:
+// SQLite не умеет менять внешний ключ через ALTER TABLE. Строки удалённых
+// ранее пользователей при переносе отбрасываются.
+func cascadeUserDelete(db *sql.DB, table string) error {
+	var count int
+	err := db.QueryRow(
+		`SELECT COUNT(*) FROM pragma_foreign_key_list(?) WHERE "table" = 'users' AND on_delete != 'CASCADE'`,
+		table,
+	).Scan(&count)
+	if err != nil || count == 0 {
+		return err
+	}
+	var schema string
+	if err := db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&schema); err != nil {
+		return err
+	}
+	createTable := regexp.MustCompile(`^CREATE TABLE\s+` + identQuote + regexp.QuoteMeta(table) + identQuote + `\s*\(`)
+	if !createTable.MatchString(schema) || !usersReference.MatchString(schema) {
+		return fmt.Errorf("rebuild %s: unexpected schema, add ON DELETE CASCADE manually: %s", table, schema)
+	}
+	schema = createTable.ReplaceAllLiteralString(schema, "CREATE TABLE "+table+"_new (")
+	schema = usersReference.ReplaceAllLiteralString(schema, "REFERENCES users(id) ON DELETE CASCADE")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	statements := []string{
+		schema,
+		fmt.Sprintf("INSERT INTO %[1]s_new SELECT * FROM %[1]s WHERE user_id IN (SELECT id FROM users)", table),
+		fmt.Sprintf("DROP TABLE %s", table),
+		fmt.Sprintf("ALTER TABLE %[1]s_new RENAME TO %[1]s", table),
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("rebuild %s: %w", table, err)
+		}
+	}
+	err = tx.QueryRow(
+		`SELECT COUNT(*) FROM pragma_foreign_key_list(?) WHERE "table" = 'users' AND on_delete != 'CASCADE'`,
+		table,
+	).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("rebuild %s: %w", table, err)
+	}
+	if count > 0 {
+		return fmt.Errorf("rebuild %s: foreign key to users still has no ON DELETE CASCADE", table)
+	}
+	return tx.Commit()
+}
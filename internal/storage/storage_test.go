@@ -2,6 +2,7 @@ package storage
 
 import (
 	"database/sql"
+	"strings"
 	"testing"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -21,6 +22,12 @@ func TestNewSQLite(t *testing.T) {
 	if !tableExists(t, db, "calculations") {
 		t.Fatal("table 'calculations' does not exist after migration")
 	}
+
+	for _, table := range []string{"webhook_endpoints", "webhook_deliveries", "idempotency_keys", "login_failures", "api_keys", "user_identities", "recovery_codes"} {
+		if !tableExists(t, db, table) {
+			t.Fatalf("table '%s' does not exist after migration", table)
+		}
+	}
 }
 
 func tableExists(t *testing.T, db *sql.DB, tableName string) bool {
@@ -36,3 +43,155 @@ func tableExists(t *testing.T, db *sql.DB, tableName string) bool {
 	}
 	return name == tableName
 }
+
+func TestMigrateAddsMissingColumns(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	// Схема до появления колонки status.
+	_, err = db.Exec(`
+	CREATE TABLE calculations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		expression TEXT NOT NULL,
+		result TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+	INSERT INTO calculations (user_id, expression, result, created_at) VALUES (1, '2+2', '4', CURRENT_TIMESTAMP);
+	`)
+	if err != nil {
+		t.Fatalf("failed to create old schema: %v", err)
+	}
+
+	if err := migrate(db); err != nil {
+		t.Fatalf("migration failed: %v", err)
+	}
+
+	var status string
+	if err := db.QueryRow("SELECT status FROM calculations WHERE expression = '2+2'").Scan(&status); err != nil {
+		t.Fatalf("failed to read status: %v", err)
+	}
+	if status != "completed" {
+		t.Fatalf("expected existing rows to be 'completed', got %q", status)
+	}
+}
+
+func TestMigrateAddsCascadeToUserTables(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	// Схема, в которой calculations ссылается на users без ON DELETE.
+	_, err = db.Exec(`
+	CREATE TABLE users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		login TEXT UNIQUE NOT NULL,
+		password_hash TEXT NOT NULL
+	);
+	CREATE TABLE calculations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		expression TEXT NOT NULL,
+		result TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	INSERT INTO users (login, password_hash) VALUES ('old', 'hash');
+	INSERT INTO calculations (user_id, expression, result, created_at) VALUES (1, '2+2', '4', CURRENT_TIMESTAMP);
+	INSERT INTO calculations (user_id, expression, result, created_at) VALUES (42, '1+1', '2', CURRENT_TIMESTAMP);
+	PRAGMA foreign_keys = ON;
+	`)
+	if err != nil {
+		t.Fatalf("failed to create old schema: %v", err)
+	}
+
+	if err := migrate(db); err != nil {
+		t.Fatalf("migration failed: %v", err)
+	}
+
+	var onDelete string
+	if err := db.QueryRow(`SELECT on_delete FROM pragma_foreign_key_list('calculations') WHERE "table" = 'users'`).Scan(&onDelete); err != nil {
+		t.Fatalf("failed to read foreign key: %v", err)
+	}
+	if onDelete != "CASCADE" {
+		t.Fatalf("expected ON DELETE CASCADE, got %q", onDelete)
+	}
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM calculations").Scan(&count)
+	if count != 1 {
+		t.Fatalf("expected only the row of the existing user to survive, got %d rows", count)
+	}
+
+	if _, err := db.Exec("DELETE FROM users WHERE id = 1"); err != nil {
+		t.Fatalf("failed to delete user: %v", err)
+	}
+	db.QueryRow("SELECT COUNT(*) FROM calculations").Scan(&count)
+	if count != 0 {
+		t.Fatalf("expected calculations to be deleted with the user, got %d rows", count)
+	}
+}
+
+func TestMigrateCascadeForeignKeySpellings(t *testing.T) {
+	cases := []struct {
+		name, table, reference string
+		ok                     bool
+	}{
+		{"space before column", "calculations", "FOREIGN KEY(user_id) REFERENCES users (id)", true},
+		{"quoted names", `"calculations"`, `FOREIGN KEY(user_id) REFERENCES "users"("id")`, true},
+		// Текстовая замена не находит ссылку без колонки.
+		{"implicit column", "calculations", "FOREIGN KEY(user_id) REFERENCES users", false},
+		// Замена проходит, но действие остаётся SET NULL.
+		{"other action", "calculations", "FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE SET NULL", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db, err := sql.Open("sqlite3", ":memory:")
+			if err != nil {
+				t.Fatalf("failed to open db: %v", err)
+			}
+			defer db.Close()
+			db.SetMaxOpenConns(1)
+
+			_, err = db.Exec(`
+			CREATE TABLE users (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				login TEXT UNIQUE NOT NULL,
+				password_hash TEXT NOT NULL
+			);
+			CREATE TABLE ` + c.table + ` (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				expression TEXT NOT NULL,
+				result TEXT NOT NULL,
+				created_at DATETIME NOT NULL,
+				` + c.reference + `
+			);
+			`)
+			if err != nil {
+				t.Fatalf("failed to create old schema: %v", err)
+			}
+
+			err = migrate(db)
+			if c.ok && err != nil {
+				t.Fatalf("migration failed: %v", err)
+			}
+			if !c.ok && (err == nil || !strings.Contains(err.Error(), "rebuild calculations")) {
+				t.Fatalf("expected explicit rebuild error, got %v", err)
+			}
+			var onDelete string
+			if err := db.QueryRow(`SELECT on_delete FROM pragma_foreign_key_list('calculations') WHERE "table" = 'users'`).Scan(&onDelete); err != nil {
+				t.Fatalf("failed to read foreign key: %v", err)
+			}
+			if c.ok && onDelete != "CASCADE" {
+				t.Fatalf("expected ON DELETE CASCADE, got %q", onDelete)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package webhook
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"distributed-calculator/internal/auth"
+)
+
+const maxDeliveriesListed = 100
+
+// MaxEndpointsPerUser ограничивает число постоянных адресов: каждое
+// вычисление рассылается на все адреса пользователя.
+var MaxEndpointsPerUser = 10
+
+type Endpoint struct {
+	ID        int64  `json:"id"`
+	URL       string `json:"url"`
+	Secret    string `json:"secret,omitempty"`
+	CreatedAt string `json:"created_at,omitempty"`
+}
+
+type RegisterEndpointRequest struct {
+	URL string `json:"url"`
+}
+
+type Delivery struct {
+	ID            int64  `json:"id"`
+	CalculationID int64  `json:"calculation_id"`
+	URL           string `json:"url"`
+	Status        string `json:"status"`
+	Attempts      int    `json:"attempts"`
+	ResponseCode  *int   `json:"response_code,omitempty"`
+	LastError     string `json:"last_error,omitempty"`
+	CreatedAt     string `json:"created_at"`
+	UpdatedAt     string `json:"updated_at"`
+}
+
+func RegisterEndpointHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.UserIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req RegisterEndpointRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := ValidateURL(req.URL); err != nil {
+			http.Error(w, "invalid url", http.StatusBadRequest)
+			return
+		}
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		endpoint := Endpoint{URL: req.URL, Secret: hex.EncodeToString(secret)}
+		// Проверка лимита и вставка одним запросом, чтобы параллельные
+		// регистрации не обошли лимит.
+		res, err := db.Exec(
+			`INSERT INTO webhook_endpoints (user_id, url, secret, created_at)
+			SELECT ?, ?, ?, CURRENT_TIMESTAMP
+			WHERE (SELECT COUNT(*) FROM webhook_endpoints WHERE user_id = ?) < ?`,
+			userID, endpoint.URL, endpoint.Secret, userID, MaxEndpointsPerUser,
+		)
+		if err != nil {
+			http.Error(w, "failed to save webhook", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "webhook limit reached", http.StatusConflict)
+			return
+		}
+		if endpoint.ID, err = res.LastInsertId(); err != nil {
+			http.Error(w, "failed to save webhook", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(endpoint)
+	}
+}
+
+func ListEndpointsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.UserIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		rows, err := db.QueryContext(r.Context(),
+			"SELECT id, url, created_at FROM webhook_endpoints WHERE user_id = ? ORDER BY id", userID)
+		if err != nil {
+			http.Error(w, "failed to load webhooks", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		endpoints := []Endpoint{}
+		for rows.Next() {
+			var endpoint Endpoint
+			if err := rows.Scan(&endpoint.ID, &endpoint.URL, &endpoint.CreatedAt); err != nil {
+				http.Error(w, "failed to load webhooks", http.StatusInternalServerError)
+				return
+			}
+			endpoints = append(endpoints, endpoint)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "failed to load webhooks", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(endpoints)
+	}
+}
+
+func DeleteEndpointHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.UserIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid webhook id", http.StatusBadRequest)
+			return
+		}
+		res, err := db.ExecContext(r.Context(), "DELETE FROM webhook_endpoints WHERE id = ? AND user_id = ?", id, userID)
+		if err != nil {
+			http.Error(w, "failed to delete webhook", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "webhook not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func DeliveriesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.UserIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		rows, err := db.QueryContext(r.Context(),
+			`SELECT id, calculation_id, url, status, attempts, response_code, last_error, created_at, updated_at
+			FROM webhook_deliveries WHERE user_id = ? ORDER BY id DESC LIMIT ?`,
+			userID, maxDeliveriesListed,
+		)
+		if err != nil {
+			http.Error(w, "failed to load deliveries", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		deliveries := []Delivery{}
+		for rows.Next() {
+			var delivery Delivery
+			var responseCode sql.NullInt64
+			var lastError sql.NullString
+			if err := rows.Scan(&delivery.ID, &delivery.CalculationID, &delivery.URL, &delivery.Status,
+				&delivery.Attempts, &responseCode, &lastError, &delivery.CreatedAt, &delivery.UpdatedAt); err != nil {
+				http.Error(w, "failed to load deliveries", http.StatusInternalServerError)
+				return
+			}
+			if responseCode.Valid {
+				code := int(responseCode.Int64)
+				delivery.ResponseCode = &code
+			}
+			delivery.LastError = lastError.String
+			deliveries = append(deliveries, delivery)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "failed to load deliveries", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(deliveries)
+	}
+}
@@ -0,0 +1,89 @@
+package webhook
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// AllowedNetworks - адреса, куда можно слать webhook-и, несмотря на то что
+// они внутренние. По умолчанию пусто; тесты с httptest добавляют сюда 127.0.0.0/8.
+var AllowedNetworks []netip.Prefix
+
+var errForbiddenAddress = errors.New("destination address not allowed")
+
+// carrierNAT - общее адресное пространство провайдеров (RFC 6598).
+var carrierNAT = netip.MustParsePrefix("100.64.0.0/10")
+
+// addressAllowed запрещает loopback, частные, link-local (в том числе
+// 169.254.169.254 с метаданными облака) и прочие не публичные адреса.
+func addressAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range AllowedNetworks {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !carrierNAT.Contains(addr)
+}
+
+// dialControl проверяет адрес, к которому реально идёт подключение, уже после
+// разрешения имени: проверка имени при регистрации не защищает от DNS,
+// который позже начнёт отвечать внутренним адресом.
+func dialControl(network, address string, c syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !addressAllowed(addrPort.Addr()) {
+		return errForbiddenAddress
+	}
+	return nil
+}
+
+func newClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second, Control: dialControl}
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		// Редирект увёл бы запрос на адрес, который не проверялся при регистрации.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func ValidateURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("url scheme must be http or https")
+	}
+	if u.Hostname() == "" {
+		return errors.New("url host required")
+	}
+	if u.User != nil {
+		return errors.New("url must not contain credentials")
+	}
+	// Имена проверяются при каждой доставке, здесь - только явные адреса.
+	host := strings.ToLower(u.Hostname())
+	if addr, err := netip.ParseAddr(host); err == nil && !addressAllowed(addr) {
+		return errForbiddenAddress
+	}
+	if (host == "localhost" || strings.HasSuffix(host, ".localhost")) && !addressAllowed(netip.MustParseAddr("127.0.0.1")) {
+		return errForbiddenAddress
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	TimestampHeader = "X-Webhook-Timestamp"
+	DeliveryHeader  = "X-Webhook-Delivery"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+)
+
+type Payload struct {
+	CalculationID int64  `json:"calculation_id"`
+	Expression    string `json:"expression"`
+	Result        string `json:"result"`
+}
+
+type Target struct {
+	URL    string
+	Secret string
+}
+
+type Dispatcher struct {
+	db          *sql.DB
+	client      *http.Client
+	MaxAttempts int
+	BaseDelay   time.Duration
+	wg          sync.WaitGroup
+}
+
+func NewDispatcher(db *sql.DB) *Dispatcher {
+	return &Dispatcher{
+		db:          db,
+		client:      newClient(),
+		MaxAttempts: 5,
+		BaseDelay:   time.Second,
+	}
+}
+
+// Sign возвращает HMAC-SHA256 от "<timestamp>.<body>" в формате "sha256=<hex>".
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Notify рассылает результат на все зарегистрированные адреса пользователя
+// и, если задан, на callback из запроса. Доставка идёт в фоне.
+func (d *Dispatcher) Notify(userID int64, payload Payload, callback *Target) error {
+	targets, err := d.endpoints(userID)
+	if err != nil {
+		return err
+	}
+	if callback != nil {
+		targets = append(targets, *callback)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	for _, target := range targets {
+		res, err := d.db.Exec(
+			"INSERT INTO webhook_deliveries (user_id, calculation_id, url, status, attempts, created_at, updated_at) VALUES (?, ?, ?, ?, 0, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)",
+			userID, payload.CalculationID, target.URL, StatusPending,
+		)
+		if err != nil {
+			return err
+		}
+		deliveryID, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		d.wg.Add(1)
+		go func(target Target) {
+			defer d.wg.Done()
+			d.deliver(deliveryID, target, body)
+		}(target)
+	}
+	return nil
+}
+
+// FailInterrupted помечает неудавшимися доставки, оставшиеся в статусе
+// pending после остановки сервиса: повторы идут в памяти процесса, и после
+// перезапуска их никто не продолжит. Вызывается при старте до первого Notify.
+func (d *Dispatcher) FailInterrupted() error {
+	_, err := d.db.Exec(
+		"UPDATE webhook_deliveries SET status = ?, last_error = ?, updated_at = CURRENT_TIMESTAMP WHERE status = ?",
+		StatusFailed, "interrupted by service restart", StatusPending,
+	)
+	return err
+}
+
+// Wait блокируется, пока не завершатся все начатые доставки.
+func (d *Dispatcher) Wait() {
+	d.wg.Wait()
+}
+
+func (d *Dispatcher) endpoints(userID int64) ([]Target, error) {
+	rows, err := d.db.Query("SELECT url, secret FROM webhook_endpoints WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var targets []Target
+	for rows.Next() {
+		var target Target
+		if err := rows.Scan(&target.URL, &target.Secret); err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	return targets, rows.Err()
+}
+
+func (d *Dispatcher) deliver(deliveryID int64, target Target, body []byte) {
+	delay := d.BaseDelay
+	for attempt := 1; attempt <= d.MaxAttempts; attempt++ {
+		code, err := d.send(deliveryID, target, body)
+
+		status := StatusPending
+		switch {
+		case err == nil:
+			status = StatusDelivered
+		case attempt == d.MaxAttempts, errors.Is(err, errForbiddenAddress):
+			status = StatusFailed
+		}
+		var lastError sql.NullString
+		if err != nil {
+			lastError = sql.NullString{String: err.Error(), Valid: true}
+		}
+		var responseCode sql.NullInt64
+		if code != 0 {
+			responseCode = sql.NullInt64{Int64: int64(code), Valid: true}
+		}
+		_, dbErr := d.db.Exec(
+			"UPDATE webhook_deliveries SET status = ?, attempts = ?, response_code = ?, last_error = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+			status, attempt, responseCode, lastError, deliveryID,
+		)
+		if dbErr != nil {
+			log.Printf("webhook delivery %d: failed to save status %s: %v", deliveryID, status, dbErr)
+		}
+		if status != StatusPending {
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (d *Dispatcher) send(deliveryID int64, target Target, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, target.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(deliveryID, 10))
+	req.Header.Set(SignatureHeader, Sign(target.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}